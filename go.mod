@@ -3,11 +3,14 @@ module github.com/pioz/god
 go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.2.0
 	github.com/charmbracelet/lipgloss v0.5.0
+	github.com/fsnotify/fsnotify v1.5.1
 	github.com/pkg/errors v0.9.1
 	github.com/pkg/sftp v1.13.4
 	golang.org/x/crypto v0.0.0-20220511200225-c6db032c6c88
 	golang.org/x/exp v0.0.0-20220518171630-0b5c67f07fdf
+	golang.org/x/sys v0.0.0-20211019181941-9d821ace8654
 	gopkg.in/yaml.v3 v3.0.0-20220512140231-539c8e751b99
 )
 
@@ -19,5 +22,4 @@ require (
 	github.com/muesli/reflow v0.2.1-0.20210115123740-9e1d0d53df68 // indirect
 	github.com/muesli/termenv v0.11.1-0.20220204035834-5ac8409525e0 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
-	golang.org/x/sys v0.0.0-20211019181941-9d821ace8654 // indirect
 )
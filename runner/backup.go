@@ -0,0 +1,146 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Layout of the timestamp in the backup archive and release names.
+const backupTimeLayout = "20060102T150405Z"
+
+// timestampedFile is a remote file whose name holds its creation time.
+type timestampedFile struct {
+	Path string
+	Size int64
+	Time time.Time
+}
+
+// BackupArchive is a backup archive of a service on the remote host.
+type BackupArchive timestampedFile
+
+// backupDirectory returns the remote directory where Backup writes the
+// archives.
+func (s *Service) backupDirectory() string {
+	return filepath.Join(s.remoteHomeDir, ".god", "backups")
+}
+
+// Backup writes on the remote host a timestamped tar.gz archive with the
+// service executable, except in go-run mode where there is none, the service
+// file, and the working directory if includeWorkingDirectory is true. Paths are
+// stored relative to / so the archive can be extracted in place by Restore.
+// Returns the archive path.
+func (s *Service) Backup(includeWorkingDirectory bool) (string, error) {
+	paths := []string{s.serviceFilePath()}
+	if executable := s.installedExecutable(); executable != "" {
+		paths = append(paths, executable)
+	}
+	if includeWorkingDirectory {
+		paths = append(paths, s.Conf.WorkingDirectory)
+	}
+	dir := s.backupDirectory()
+	archive := filepath.Join(dir, fmt.Sprintf("%s-%s.tar.gz", s.Name, time.Now().UTC().Format(backupTimeLayout)))
+	args := []string{"--exclude=" + shellQuote(strings.TrimPrefix(filepath.Join(s.remoteHomeDir, ".god"), "/"))}
+	for _, path := range paths {
+		args = append(args, shellQuote(strings.TrimPrefix(path, "/")))
+	}
+	cmd := fmt.Sprintf("mkdir -p %s && tar -czf %s -C / %s", shellQuote(dir), shellQuote(archive), strings.Join(args, " "))
+	s.runner.SendMessage(s.Name, cmd, MessageNormal)
+	output, err := s.Exec(cmd)
+	if err != nil {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("cannot create backup: %s", output), MessageError)
+		return "", err
+	}
+	s.runner.SendMessage(s.Name, fmt.Sprintf("Backup written to '%s'", archive), MessageSuccess)
+	return archive, nil
+}
+
+// Restore stops the service, extracts archive in place and starts the service
+// again. If archive is empty, the latest backup of the service is restored. If
+// the extraction fails, the service is started again anyway, with the files
+// possibly partially restored, and the error says if it cannot be started.
+func (s *Service) Restore(archive string) error {
+	if archive == "" {
+		archives, err := s.Backups()
+		if err == nil && len(archives) == 0 {
+			err = fmt.Errorf("no backup found in '%s'", s.backupDirectory())
+		}
+		if err != nil {
+			s.runner.SendMessage(s.Name, err.Error(), MessageError)
+			return err
+		}
+		archive = archives[0].Path
+	}
+	if err := s.StopService(); err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("tar -xzf %s -C /", shellQuote(archive))
+	s.runner.SendMessage(s.Name, cmd, MessageNormal)
+	output, err := s.Exec(cmd)
+	if err != nil {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("cannot restore backup '%s': %s", archive, output), MessageError)
+		startErr := s.ReloadDaemon()
+		if startErr == nil {
+			startErr = s.StartService()
+		}
+		if startErr != nil {
+			return fmt.Errorf("%w: the service is left stopped: %s", err, startErr)
+		}
+		return err
+	}
+	s.runner.SendMessage(s.Name, fmt.Sprintf("Restored '%s'", archive), MessageSuccess)
+	if err := s.ReloadDaemon(); err != nil {
+		return err
+	}
+	return s.StartService()
+}
+
+// Backups returns the backup archives of the service on the remote host, the
+// most recent first.
+func (s *Service) Backups() ([]BackupArchive, error) {
+	// The timestamp must follow the service name, so that the archives of a
+	// service named like a prefix of this one are not matched
+	files, err := s.timestampedFiles(s.backupDirectory(), s.Name+"-", ".tar.gz")
+	if err != nil {
+		return nil, err
+	}
+	archives := make([]BackupArchive, len(files))
+	for i, file := range files {
+		archives[i] = BackupArchive(file)
+	}
+	return archives, nil
+}
+
+// timestampedFiles returns the regular files of the remote directory dir
+// named prefix, a timestamp and suffix, the most recent first. If dir does
+// not exist, there are no files.
+func (s *Service) timestampedFiles(dir, prefix, suffix string) ([]timestampedFile, error) {
+	if err := s.client.ConnectSftpClient(); err != nil {
+		return nil, err
+	}
+	entries, err := s.client.SftClient.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read '%s': %s", dir, err)
+	}
+	var files []timestampedFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) || !entry.Mode().IsRegular() {
+			continue
+		}
+		t, err := time.Parse(backupTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix))
+		if err != nil {
+			continue
+		}
+		files = append(files, timestampedFile{Path: filepath.Join(dir, name), Size: entry.Size(), Time: t})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Time.After(files[j].Time) })
+	return files, nil
+}
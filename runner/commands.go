@@ -1,10 +1,18 @@
 package runner
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/exp/slices"
@@ -12,18 +20,53 @@ import (
 
 func (s *Service) CheckGo() error {
 	errorMessage := fmt.Sprintf("couldn't find the `go` executable. Please install `go` or set the executable path in `%s` file using the `go_exec_path` variable", s.runner.confFilePath)
-	cmd := s.ParseCommand("{{.GoExecPath}} version")
+	cmd := s.mustParseCommand("{{.GoExecPath}} version")
 	return s.PrintExec(cmd, errorMessage)
 }
 
 func (s *Service) CheckSystemd() error {
 	errorMessage := fmt.Sprintf("couldn't find the `systemd` executable. Please install `systemd` or set the executable path in `%s` file using the `systemd_path` variable", s.runner.confFilePath)
-	cmd := s.ParseCommand("{{.SystemdPath}} --version")
-	return s.PrintExec(cmd, errorMessage)
+	if s.Conf.InitSystem != "" && s.Conf.InitSystem != "systemd" {
+		errorMessage = fmt.Sprintf("couldn't find the `%s` init system on the remote host", s.Conf.InitSystem)
+	}
+	cmd := s.initCommand(s.initSystem().check)
+	if err := s.PrintExec(cmd, errorMessage); err != nil {
+		return err
+	}
+	if s.Conf.InitSystem == "" || s.Conf.InitSystem == "systemd" {
+		s.checkSystemdVersion()
+	}
+	return nil
+}
+
+// Minimum systemd version that supports RestartSteps and RestartMaxDelaySec.
+const restartBackoffSystemdVersion = 254
+
+// checkSystemdVersion warns if the remote systemd is too old for the restart
+// backoff configuration.
+func (s *Service) checkSystemdVersion() {
+	if s.Conf.RestartSteps == 0 && s.Conf.RestartMaxDelaySec == 0 {
+		return
+	}
+	output, err := s.Exec(s.mustParseCommand("{{.SystemdPath}} --version"))
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(output)
+	if len(fields) < 2 {
+		return
+	}
+	version, err := strconv.Atoi(fields[1])
+	if err == nil && version < restartBackoffSystemdVersion {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("systemd %d does not support `restart_steps` and `restart_max_delay_sec`: they require systemd %d or later and will be ignored", version, restartBackoffSystemdVersion), MessageWarning)
+	}
 }
 
 func (s *Service) CheckLingering() error {
-	cmd := s.ParseCommand("ls {{.SystemdLingerDirectory}}")
+	if !s.initSystem().lingering || s.Conf.SkipLingerCheck || s.runner.AssumeLinger {
+		return nil
+	}
+	cmd := s.mustParseCommand("ls {{.SystemdLingerDirectory}}")
 	s.runner.SendMessage(s.Name, cmd, MessageNormal)
 	output, err := s.Exec(cmd)
 	if err != nil {
@@ -39,8 +82,131 @@ func (s *Service) CheckLingering() error {
 	return nil
 }
 
+// remoteCheck is a read-only check run on the remote host by CheckRemote. The
+// check passes if cmd exits with 0.
+type remoteCheck struct {
+	// What is checked, ex: "working_directory '/srv/app'", and the property it
+	// must have, ex: "accessible"
+	subject, property string
+	cmd               string
+	// If true, a failure is reported as a warning
+	optional bool
+}
+
+// CheckRemote checks, without changing anything, that the remote host is ready
+// to install the service: the directories where god writes are writable, or
+// can be created, and the working directory is accessible. It returns an error
+// if any required check fails.
+func (s *Service) CheckRemote() error {
+	// Directories created on install only need the nearest existing parent to be
+	// writable
+	writable := func(dir string) string {
+		return fmt.Sprintf(`d=%s; while [ ! -e "$d" ]; do d=$(dirname "$d"); done; test -d "$d" && test -w "$d"`, shellQuote(dir))
+	}
+	execDir := filepath.Dir(execPath(s.Conf.ExecStart))
+	checks := []remoteCheck{
+		{subject: fmt.Sprintf("go_bin_directory '%s'", s.Conf.GoBinDirectory), property: "writable", cmd: writable(s.Conf.GoBinDirectory)},
+		{subject: fmt.Sprintf("services directory '%s'", s.Conf.SystemdServicesDirectory), property: "writable", cmd: writable(s.Conf.SystemdServicesDirectory)},
+		{subject: fmt.Sprintf("working_directory '%s'", s.Conf.WorkingDirectory), property: "accessible", cmd: fmt.Sprintf("test -d %[1]s && test -x %[1]s", shellQuote(s.Conf.WorkingDirectory))},
+		{subject: fmt.Sprintf("exec_start directory '%s'", execDir), property: "in $PATH", cmd: fmt.Sprintf(`case ":$PATH:" in *:%s:*) true ;; *) false ;; esac`, shellQuote(execDir)), optional: true},
+	}
+	if s.Conf.LogPath != "" {
+		checks = append(checks, remoteCheck{subject: fmt.Sprintf("log_path directory '%s'", filepath.Dir(s.Conf.LogPath)), property: "writable", cmd: writable(filepath.Dir(s.Conf.LogPath))})
+	}
+	failed := 0
+	for _, check := range checks {
+		_, err := s.Exec(check.cmd)
+		switch {
+		case err == nil:
+			s.runner.SendMessage(s.Name, fmt.Sprintf("%s is %s", check.subject, check.property), MessageSuccess)
+		case check.optional:
+			s.runner.SendMessage(s.Name, fmt.Sprintf("%s is not %s", check.subject, check.property), MessageWarning)
+		default:
+			s.runner.SendMessage(s.Name, fmt.Sprintf("%s is not %s", check.subject, check.property), MessageError)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d remote checks failed", failed)
+	}
+	return nil
+}
+
+// CheckDiskSpace checks that the filesystems of go_bin_directory and of the
+// working directory have at least min_free_disk_mb megabytes free.
+func (s *Service) CheckDiskSpace() error {
+	if s.Conf.MinFreeDiskMB <= 0 {
+		return nil
+	}
+	checked := make(map[string]bool)
+	for _, dir := range []string{s.Conf.GoBinDirectory, s.Conf.WorkingDirectory} {
+		// df needs an existing path: use the nearest existing parent
+		cmd := fmt.Sprintf(`d=%s; while [ ! -e "$d" ]; do d=$(dirname "$d"); done; df -Pk "$d" | tail -n 1`, shellQuote(dir))
+		output, err := s.Exec(cmd)
+		fields := strings.Fields(output)
+		if err != nil || len(fields) < 6 {
+			s.runner.SendMessage(s.Name, fmt.Sprintf("cannot check the free disk space of '%s': %s", dir, output), MessageError)
+			return fmt.Errorf("cannot check the free disk space of '%s'", dir)
+		}
+		filesystem, mountPoint := fields[0], fields[5]
+		if checked[filesystem] {
+			continue
+		}
+		checked[filesystem] = true
+		available, err := strconv.Atoi(fields[3])
+		if err != nil {
+			s.runner.SendMessage(s.Name, fmt.Sprintf("cannot parse the df output: %s", output), MessageError)
+			return err
+		}
+		if free := available / 1024; free < s.Conf.MinFreeDiskMB {
+			err = fmt.Errorf("filesystem `%s` mounted on `%s` has %d MB free, less than min_free_disk_mb %d MB", filesystem, mountPoint, free, s.Conf.MinFreeDiskMB)
+			s.runner.SendMessage(s.Name, err.Error(), MessageError)
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckDependencies warns if a unit referenced by run_after_service does not
+// exist on the remote host, since the init system silently ignores it. In
+// strict deps mode it is an error.
+func (s *Service) CheckDependencies() error {
+	cmd := s.initSystem().unitLoaded
+	if cmd == "" || s.Conf.RunAfterService == "" {
+		return nil
+	}
+	var missing []string
+	for _, unit := range strings.Fields(s.Conf.RunAfterService) {
+		output, err := s.Exec(s.unitCommand(cmd, shellQuote(unit)))
+		if err != nil {
+			s.runner.SendMessage(s.Name, fmt.Sprintf("cannot check the unit `%s`: %s", unit, output), MessageError)
+			return err
+		}
+		if strings.TrimSpace(output) != "loaded" {
+			missing = append(missing, unit)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	message := fmt.Sprintf("run_after_service references units that do not exist on the remote host: %s", strings.Join(missing, ", "))
+	if s.runner.StrictDeps {
+		s.runner.SendMessage(s.Name, message, MessageError)
+		return errors.New(message)
+	}
+	s.runner.SendMessage(s.Name, message, MessageWarning)
+	return nil
+}
+
+// CheckWorkingDir checks that the service working directory exists on the
+// remote host, creating it if createWorkingDirectory is true. The
+// create_working_directory configuration, if set, takes precedence over
+// createWorkingDirectory.
 func (s *Service) CheckWorkingDir(createWorkingDirectory bool) error {
-	cmd := s.ParseCommand("test -e {{.WorkingDirectory}}")
+	if s.Conf.CreateWorkingDirectory != nil {
+		createWorkingDirectory = *s.Conf.CreateWorkingDirectory
+	}
+	cmd := s.mustParseCommand("test -e {{.WorkingDirectory}}")
 	s.runner.SendMessage(s.Name, cmd, MessageNormal)
 	_, err := s.Exec(cmd)
 	if err == nil {
@@ -51,7 +217,13 @@ func (s *Service) CheckWorkingDir(createWorkingDirectory bool) error {
 		s.runner.SendMessage(s.Name, fmt.Sprintf("Service working directory '%s' does not exist on the remote host", s.Conf.WorkingDirectory), MessageError)
 		return err
 	}
-	cmd = s.ParseCommand("mkdir -p {{.WorkingDirectory}}")
+	// The mode is set only on the directory created here, never on an
+	// existing one
+	if s.Conf.WorkingDirectoryMode != "" {
+		cmd = s.mustParseCommand("mkdir -p -m {{.WorkingDirectoryMode}} {{.WorkingDirectory}}")
+	} else {
+		cmd = s.mustParseCommand("mkdir -p {{.WorkingDirectory}}")
+	}
 	s.runner.SendMessage(s.Name, cmd, MessageNormal)
 	output, err := s.Exec(cmd)
 	if err != nil {
@@ -65,56 +237,358 @@ func (s *Service) CheckWorkingDir(createWorkingDirectory bool) error {
 func (s *Service) AuthPrivateRepo() error {
 	if s.Conf.GoPrivate != "" {
 		s.runner.SendMessage(s.Name, "GO_PRIVATE found: edit .netrc file", MessageNormal)
-		auth := fmt.Sprintf("machine %s login %s password %s", s.Conf.NetrcMachine, s.Conf.NetrcLogin, s.Conf.NetrcPassword)
-		output, err := s.Exec("cat ~/.netrc")
-		if !strings.Contains(output, auth) {
-			var cmd string
-			if err != nil {
-				cmd = fmt.Sprintf("echo '%s' > ~/.netrc", auth)
-			} else {
-				cmd = fmt.Sprintf("echo '%s\n%s' > ~/.netrc", auth, output)
-			}
-			_, err := s.Exec(cmd)
-			if err != nil {
-				s.runner.SendMessage(s.Name, err.Error(), MessageError)
-				return err
-			}
+		err := s.updateNetrc()
+		if err != nil {
+			s.runner.SendMessage(s.Name, err.Error(), MessageError)
+			return err
 		}
 		s.runner.SendMessage(s.Name, "", MessageSuccess)
 	}
 	return nil
 }
 
+// updateNetrc sets the netrc_machine entry in the remote ~/.netrc file,
+// preserving the other entries. The file is written atomically with 0600
+// permissions.
+func (s *Service) updateNetrc() error {
+	err := s.client.ConnectSftpClient()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.remoteHomeDir, ".netrc")
+	var content string
+	file, err := s.client.SftClient.Open(path)
+	if err == nil {
+		var buf bytes.Buffer
+		_, err = file.WriteTo(&buf)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		content = buf.String()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	updated := setNetrcMachine(content, s.Conf.NetrcMachine, s.Conf.NetrcLogin, s.Conf.NetrcPassword)
+	if updated == content {
+		return nil
+	}
+	return s.uploadFile(path, strings.NewReader(updated), 0600)
+}
+
+// RunPreBuild runs the pre_build command on the local host, sending its output
+// on the runner channel line by line.
+func (s *Service) RunPreBuild() error {
+	if s.Conf.PreBuild == "" {
+		return nil
+	}
+	s.runner.SendMessage(s.Name, s.Conf.PreBuild, MessageNormal)
+	cmd := exec.CommandContext(s.runContext(), "sh", "-c", s.Conf.PreBuild)
+	cmd.Dir = s.Conf.PreBuildDirectory
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		s.runner.SendMessage(s.Name, err.Error(), MessageError)
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		s.runner.SendMessage(s.Name, err.Error(), MessageError)
+		return err
+	}
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		s.runner.SendMessage(s.Name, scanner.Text(), MessageNormal)
+	}
+	if err := cmd.Wait(); err != nil {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("pre_build failed: %s", err), MessageError)
+		return err
+	}
+	s.runner.SendMessage(s.Name, "", MessageSuccess)
+	return nil
+}
+
 func (s *Service) InstallExecutable() error {
-	var cmd string
-	if s.Conf.GoPrivate != "" {
-		cmd = s.ParseCommand("GOPRIVATE={{.GoPrivate}} {{.GoExecPath}} install {{.GoInstall}}")
+	// Marker file used to find the executables written by go install
+	marker, err := s.Exec("mktemp")
+	if err == nil {
+		defer s.Exec(fmt.Sprintf("rm -f %s", marker))
 	} else {
-		cmd = s.ParseCommand("{{.GoExecPath}} install {{.GoInstall}}")
+		marker = ""
 	}
-	errorMessage := fmt.Sprintf("cannot install the package `%s`", s.Conf.GoInstall)
-	s.runner.SendMessage(s.Name, cmd, MessageNormal)
+	packages := append([]string{s.Conf.GoInstall}, s.Conf.ExtraInstalls...)
+	if s.Conf.RunMode == "go-run" {
+		packages = s.Conf.ExtraInstalls
+	} else if s.Conf.GitRepo != "" {
+		if err := s.buildFromRepo(); err != nil {
+			return err
+		}
+		packages = s.Conf.ExtraInstalls
+	}
+	for _, pkg := range packages {
+		if err := s.installPackage(pkg); err != nil {
+			return err
+		}
+	}
+	if s.Conf.RunMode == "go-run" {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("Skipped `%s`: the service runs it with go run", s.Conf.GoInstall), MessageSuccess)
+		return nil
+	}
+	cmd := s.mustParseCommand("file {{.ExecStart}}")
+	errorMessage := fmt.Sprintf("couldn't find the `%s` executable", s.Conf.ExecStart)
 	output, err := s.Exec(cmd)
 	if err != nil {
-		errorMessage = fmt.Sprintf("%s: %s", errorMessage, output)
+		if marker != "" {
+			installed := s.newExecutables(marker)
+			if len(installed) > 0 && !slices.Contains(installed, filepath.Base(s.Conf.ExecStart)) {
+				errorMessage = fmt.Sprintf("go install produced `%s` but exec_start expects `%s`: please add `exec_start: %s` in `%s` file", strings.Join(installed, "`, `"), filepath.Base(s.Conf.ExecStart), filepath.Join(s.Conf.GoBinDirectory, installed[0]), s.runner.confFilePath)
+				s.runner.SendMessage(s.Name, errorMessage, MessageError)
+				return err
+			}
+		}
 		s.runner.SendMessage(s.Name, fmt.Sprintf("%s: %s", errorMessage, output), MessageError)
 		return err
 	}
-	cmd = s.ParseCommand("file {{.ExecStart}}")
-	errorMessage = fmt.Sprintf("couldn't find the `%s` executable", s.Conf.ExecStart)
-	output, err = s.Exec(cmd)
+	s.runner.SendMessage(s.Name, "Installed", MessageSuccess)
+	return nil
+}
+
+// forwardedEnv returns the variable assignments, to prefix to a remote
+// command, of the local environment variables listed in forward_env. Variables
+// not set locally are skipped with a warning.
+func (s *Service) forwardedEnv() string {
+	var env strings.Builder
+	for _, name := range s.Conf.ForwardEnv {
+		value, found := os.LookupEnv(name)
+		if !found {
+			s.runner.SendMessage(s.Name, fmt.Sprintf("forward_env: `%s` is not set in the local environment", name), MessageWarning)
+			continue
+		}
+		fmt.Fprintf(&env, "%s=%s ", name, shellQuote(value))
+	}
+	return env.String()
+}
+
+// shellQuote quotes value to be used as a single word in a shell command.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// buildFromRepo clones git_repo in the build directory, or fetches it if
+// already cloned, checks out git_ref and runs the build command there. The
+// default build command builds the go_install package into go_bin_directory.
+func (s *Service) buildFromRepo() error {
+	dir := shellQuote(s.Conf.BuildDirectory)
+	cmd := fmt.Sprintf("if [ ! -d %[1]s/.git ]; then git clone %[2]s %[1]s; fi && git -C %[1]s fetch origin", dir, shellQuote(s.Conf.GitRepo))
+	if s.Conf.GitRef != "" {
+		cmd += fmt.Sprintf(" %s && git -C %s checkout --force FETCH_HEAD", shellQuote(s.Conf.GitRef), dir)
+	} else {
+		cmd += fmt.Sprintf(" && git -C %s checkout --force origin/HEAD", dir)
+	}
+	s.runner.SendMessage(s.Name, cmd, MessageNormal)
+	output, err := s.Exec(cmd)
 	if err != nil {
-		s.runner.SendMessage(s.Name, fmt.Sprintf("%s: %s", errorMessage, output), MessageError)
+		s.runner.SendMessage(s.Name, fmt.Sprintf("cannot check out `%s`: %s", s.Conf.GitRepo, output), MessageError)
+		return err
+	}
+
+	if s.Conf.BuildCommand != "" {
+		cmd, err = s.ParseCommand(s.Conf.BuildCommand)
+		if err != nil {
+			s.runner.SendMessage(s.Name, fmt.Sprintf("invalid `build_command`: %s", err), MessageError)
+			return err
+		}
+	} else {
+		cmd = fmt.Sprintf("%s build -o %s %s", s.Conf.GoExecPath, filepath.Join(s.Conf.GoBinDirectory, getExec(s.Conf.GoInstall)), strings.SplitN(s.Conf.GoInstall, "@", 2)[0])
+	}
+	if s.Conf.GoPrivate != "" {
+		cmd = fmt.Sprintf("GOPRIVATE=%s %s", s.Conf.GoPrivate, cmd)
+	}
+	s.runner.SendMessage(s.Name, cmd, MessageNormal)
+	output, err = s.Exec(fmt.Sprintf("cd %s && %s%s", dir, s.forwardedEnv(), cmd))
+	if err != nil {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("cannot build `%s`: %s", s.Conf.GitRepo, output), MessageError)
+		return err
+	}
+	return nil
+}
+
+// installPackage runs go install for pkg, retrying transient failures up to
+// install_retries times.
+func (s *Service) installPackage(pkg string) error {
+	// GOBIN makes go install put the executable in go_bin_directory, where
+	// exec_start expects it, whatever the GOBIN of the remote host
+	var cmd string
+	if s.Conf.GoPrivate != "" {
+		cmd = s.mustParseCommand("GOPRIVATE={{.GoPrivate}} GOBIN={{.GoBinDirectory}} {{.GoExecPath}} install ") + pkg
+	} else {
+		cmd = s.mustParseCommand("GOBIN={{.GoBinDirectory}} {{.GoExecPath}} install ") + pkg
+	}
+	errorMessage := fmt.Sprintf("cannot install the package `%s`", pkg)
+	s.runner.SendMessage(s.Name, cmd, MessageNormal)
+	// The forwarded variables are not part of the printed command, so their
+	// values are never shown
+	cmd = s.forwardedEnv() + cmd
+	output, err := s.Exec(cmd)
+	for attempt := 1; err != nil && attempt <= s.Conf.InstallRetries && isRetryableInstallError(output); attempt++ {
+		delay := time.Duration(1<<(attempt-1)) * 2 * time.Second
+		s.runner.SendMessage(s.Name, fmt.Sprintf("%s: %s. Retrying in %s (%d/%d)", errorMessage, output, delay, attempt, s.Conf.InstallRetries), MessageWarning)
+		select {
+		case <-time.After(delay):
+		case <-s.runContext().Done():
+		}
+		output, err = s.Exec(cmd)
+	}
+	if err != nil {
+		if class := classifyInstallError(output); class != nil {
+			errorMessage = fmt.Sprintf("%s (%s): %s. Hint: %s", errorMessage, class.name, output, class.hint)
+		} else {
+			errorMessage = fmt.Sprintf("%s: %s", errorMessage, output)
+		}
+		s.runner.SendMessage(s.Name, errorMessage, MessageError)
 		return err
 	}
-	s.runner.SendMessage(s.Name, "Installed", MessageSuccess)
 	return nil
 }
 
+// installErrorClass is a kind of go install failure recognized by the output.
+type installErrorClass struct {
+	name       string
+	hint       string
+	retryable  bool
+	signatures []string
+}
+
+var installErrorClasses = []installErrorClass{
+	{
+		name:       "authentication error",
+		hint:       "check `go_private` and the `netrc_*` credentials, and that the token can read the repository",
+		signatures: []string{"401 Unauthorized", "403 Forbidden", "terminal prompts disabled", "Authentication failed", "could not read Username", "Permission denied (publickey)"},
+	},
+	{
+		name:       "version not found",
+		hint:       "check the version suffix of the package, ex: @latest, and that the tag or commit exists",
+		signatures: []string{"no matching versions", "unknown revision", "invalid version"},
+	},
+	{
+		name:       "package not found",
+		hint:       "check the package path: it must refer to an existing main package",
+		signatures: []string{"404 Not Found", "410 Gone", "is not a main package", "cannot find module", "malformed module path", "repository not found", "does not contain package"},
+	},
+	{
+		name:       "network error",
+		hint:       "check the network connection of the remote host and the GOPROXY settings",
+		retryable:  true,
+		signatures: []string{"i/o timeout", "TLS handshake timeout", "connection refused", "connection reset", "no such host", "temporary failure in name resolution", "502 Bad Gateway", "503 Service Unavailable", "504 Gateway Timeout"},
+	},
+}
+
+// classifyInstallError returns the class of the go install failure with output,
+// or nil if it is not recognized.
+func classifyInstallError(output string) *installErrorClass {
+	lowerOutput := strings.ToLower(output)
+	for i := range installErrorClasses {
+		for _, signature := range installErrorClasses[i].signatures {
+			if strings.Contains(lowerOutput, strings.ToLower(signature)) {
+				return &installErrorClasses[i]
+			}
+		}
+	}
+	return nil
+}
+
+// isRetryableInstallError reports whether the go install failure with output
+// is classified as transient. Unrecognized failures, like compile errors, are
+// not retried.
+func isRetryableInstallError(output string) bool {
+	class := classifyInstallError(output)
+	return class != nil && class.retryable
+}
+
+// newExecutables returns the names of the files in GoBinDirectory modified
+// after the marker file was created.
+func (s *Service) newExecutables(marker string) []string {
+	cmd := s.mustParseCommand("find {{.GoBinDirectory}} -maxdepth 1 -type f -newer ") + marker
+	output, err := s.Exec(cmd)
+	if err != nil || output == "" {
+		return nil
+	}
+	var names []string
+	for _, path := range strings.Split(output, "\n") {
+		names = append(names, filepath.Base(path))
+	}
+	return names
+}
+
 func (s *Service) DeleteExecutable() error {
-	errorMessage := fmt.Sprintf("cannot delete service binary file `%s`", s.Conf.ExecStart)
-	cmd := s.ParseCommand("rm {{.ExecStart}}")
-	return s.PrintExec(cmd, errorMessage)
+	var err error
+	if executable := s.installedExecutable(); executable != "" {
+		errorMessage := fmt.Sprintf("cannot delete service binary file `%s`", executable)
+		err = s.PrintExec(fmt.Sprintf("rm %s", executable), errorMessage)
+	}
+	for _, filename := range s.extraExecutables() {
+		errorMessage := fmt.Sprintf("cannot delete binary file `%s`", filename)
+		if e := s.PrintExec(fmt.Sprintf("rm %s", filename), errorMessage); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// installedExecutable returns the path of the service executable installed by
+// install, or an empty string in go-run mode, where exec_start runs the go
+// command.
+func (s *Service) installedExecutable() string {
+	if s.Conf.RunMode == "go-run" {
+		return ""
+	}
+	return execPath(s.Conf.ExecStart)
+}
+
+// extraExecutables returns the paths of the executables of extra_installs.
+func (s *Service) extraExecutables() []string {
+	var paths []string
+	for _, pkg := range s.Conf.ExtraInstalls {
+		paths = append(paths, filepath.Join(s.Conf.GoBinDirectory, getExec(pkg)))
+	}
+	return paths
+}
+
+// VerifyUninstalled checks that the service is gone from the remote host: the
+// service file and the executables are deleted and the init system does not
+// know the unit anymore. In dry-run mode, it only prints what is still
+// installed.
+func (s *Service) VerifyUninstalled() error {
+	var leftovers []string
+	paths := []string{s.serviceFilePath()}
+	if executable := s.installedExecutable(); executable != "" {
+		paths = append(paths, executable)
+	}
+	for _, path := range append(paths, s.extraExecutables()...) {
+		if _, err := s.Exec(fmt.Sprintf("test ! -e %s", shellQuote(path))); err != nil {
+			leftovers = append(leftovers, fmt.Sprintf("`%s` still exists", path))
+		}
+	}
+	if cmd := s.initSystem().unitLoaded; cmd != "" {
+		output, err := s.Exec(s.initCommand(cmd))
+		if err == nil && strings.TrimSpace(output) == "loaded" {
+			leftovers = append(leftovers, fmt.Sprintf("unit `%s` is still loaded", s.unitName()))
+		}
+	}
+	// In dry-run mode nothing was deleted, so the leftovers are what uninstall
+	// would remove
+	if s.runner.DryRun {
+		if len(leftovers) > 0 {
+			s.runner.SendMessage(s.Name, fmt.Sprintf("Left for uninstall to remove: %s", strings.Join(leftovers, ", ")), MessageNormal)
+		}
+		return nil
+	}
+	if len(leftovers) > 0 {
+		err := fmt.Errorf("service not completely uninstalled: %s", strings.Join(leftovers, ", "))
+		s.runner.SendMessage(s.Name, err.Error(), MessageError)
+		return err
+	}
+	s.runner.SendMessage(s.Name, "Uninstalled", MessageSuccess)
+	return nil
 }
 
 func (s *Service) CreateServiceFile() error {
@@ -129,44 +603,160 @@ func (s *Service) CreateServiceFile() error {
 	return nil
 }
 
+// CheckCopyFiles checks that all copy_files paths exist locally, so that a
+// missing file fails the install before anything is changed on the remote
+// host.
+func (s *Service) CheckCopyFiles() error {
+	for _, copyFile := range s.Conf.CopyFiles {
+		if _, err := os.Stat(copyFile.Path); err != nil {
+			err = fmt.Errorf("copy_files path '%s' does not exist", copyFile.Path)
+			s.runner.SendMessage(s.Name, err.Error(), MessageError)
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *Service) CopyFiles() error {
 	if len(s.Conf.CopyFiles) > 0 {
 		s.runner.SendMessage(s.Name, "Copying files", MessageNormal)
-		for _, path := range s.Conf.CopyFiles {
-			err := s.CopyFile(path, s.Conf.WorkingDirectory)
+		for _, copyFile := range s.Conf.CopyFiles {
+			err := s.CopyFile(copyFile.Path, s.Conf.WorkingDirectory)
 			if err != nil {
-				errorMessage := fmt.Sprintf("cannot copy file '%s': %s", path, err)
+				errorMessage := fmt.Sprintf("cannot copy file '%s': %s", copyFile.Path, err)
 				s.runner.SendMessage(s.Name, errorMessage, MessageError)
 				return err
 			}
+			if err := s.chownCopiedFile(copyFile); err != nil {
+				return err
+			}
 		}
 		s.runner.SendMessage(s.Name, "All files copied", MessageSuccess)
 	}
 	return nil
 }
 
+// chownCopiedFiles sets the owner and group of all copied files.
+func (s *Service) chownCopiedFiles() error {
+	for _, copyFile := range s.Conf.CopyFiles {
+		if err := s.chownCopiedFile(copyFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFilesChanged reports whether a local file of copy_files differs from its
+// copy on the remote host, comparing their SHA-256 checksums. A file missing
+// on the remote host, or that cannot be checked, is changed.
+func (s *Service) copyFilesChanged() bool {
+	localChecksums := make(map[string]string)
+	for _, copyFile := range s.Conf.CopyFiles {
+		err := s.client.WalkDir(copyFile.Path, s.Conf.WorkingDirectory, func(localPath, remotePath string, info fs.DirEntry, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			file, err := os.Open(localPath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			localChecksums[remotePath], err = fileChecksum(file)
+			return err
+		})
+		if err != nil {
+			return true
+		}
+	}
+	if len(localChecksums) == 0 {
+		return false
+	}
+	args := make([]string, 0, len(localChecksums))
+	for remotePath := range localChecksums {
+		args = append(args, shellQuote(remotePath))
+	}
+	output, err := s.Exec("sha256sum " + strings.Join(args, " "))
+	if err != nil {
+		return true
+	}
+	remoteChecksums := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if checksum, path, found := strings.Cut(line, "  "); found {
+			remoteChecksums[path] = checksum
+		}
+	}
+	for remotePath, checksum := range localChecksums {
+		if remoteChecksums[remotePath] != checksum {
+			return true
+		}
+	}
+	return false
+}
+
+// chownCopiedFile sets the owner and group of the copied file, recursively if
+// it is a directory. If the SSH user is not allowed to, chown is retried with
+// passwordless sudo.
+func (s *Service) chownCopiedFile(copyFile CopyFile) error {
+	if copyFile.Owner == "" && copyFile.Group == "" {
+		return nil
+	}
+	owner := copyFile.Owner
+	if copyFile.Group != "" {
+		owner += ":" + copyFile.Group
+	}
+	remotePath := filepath.Join(s.Conf.WorkingDirectory, filepath.Base(copyFile.Path))
+	cmd := fmt.Sprintf("chown -R %s %s", shellQuote(owner), shellQuote(remotePath))
+	s.runner.SendMessage(s.Name, cmd, MessageNormal)
+	output, err := s.Exec(cmd)
+	if err != nil && strings.Contains(output, "Operation not permitted") {
+		output, err = s.Exec("sudo -n " + cmd)
+		if err != nil {
+			output = fmt.Sprintf("user `%s` is not allowed to change the owner of '%s' and cannot run chown with passwordless sudo: %s", s.Conf.User, remotePath, output)
+		}
+	}
+	if err != nil {
+		s.runner.SendMessage(s.Name, output, MessageError)
+		return err
+	}
+	return nil
+}
+
+// DeleteFiles deletes the copy_files files from the working directory and, if
+// removeWorkingDirectory, the log file and the working directory if empty.
+// Every deletion is tried, and the returned error lists the failed ones.
 func (s *Service) DeleteFiles(removeWorkingDirectory bool) error {
+	var failures []string
 	if len(s.Conf.CopyFiles) > 0 {
 		s.runner.SendMessage(s.Name, "Deleting files", MessageNormal)
-		for _, path := range s.Conf.CopyFiles {
-			err := s.DeleteFile(path, s.Conf.WorkingDirectory)
+		for _, copyFile := range s.Conf.CopyFiles {
+			err := s.DeleteFile(copyFile.Path, s.Conf.WorkingDirectory)
 			if err != nil {
-				errorMessage := fmt.Sprintf("cannot delete file '%s': %s", path, err)
-				s.runner.SendMessage(s.Name, errorMessage, MessageWarning)
+				errorMessage := fmt.Sprintf("cannot delete file '%s': %s", copyFile.Path, err)
+				s.runner.SendMessage(s.Name, errorMessage, MessageError)
+				failures = append(failures, errorMessage)
 			}
 		}
-		s.runner.SendMessage(s.Name, "All files deleted", MessageSuccess)
+		if len(failures) == 0 {
+			s.runner.SendMessage(s.Name, "All files deleted", MessageSuccess)
+		}
 	}
 	if removeWorkingDirectory {
-		if s.Conf.LogPath != "" {
+		if s.Conf.LogPath != "" && (s.runner.KeepLogs || s.Conf.PreserveLogsOnUninstall) {
+			s.runner.SendMessage(s.Name, fmt.Sprintf("Keeping log file '%s'", s.Conf.LogPath), MessageNormal)
+		} else if s.Conf.LogPath != "" {
 			s.runner.SendMessage(s.Name, fmt.Sprintf("Deleting log file '%s'", s.Conf.LogPath), MessageNormal)
 			err := s.client.ConnectSftpClient()
-			if err != nil {
-				s.runner.SendMessage(s.Name, fmt.Sprintf("Cannot delete log file '%s': %s", s.Conf.LogPath, err.Error()), MessageError)
+			if err == nil {
+				err = s.client.SftClient.Remove(s.Conf.LogPath)
+			}
+			// Nothing to delete if the service never wrote logs
+			if os.IsNotExist(err) {
+				err = nil
 			}
-			err = s.client.SftClient.Remove(s.Conf.LogPath)
 			if err != nil {
-				s.runner.SendMessage(s.Name, fmt.Sprintf("Cannot delete log file '%s': %s", s.Conf.LogPath, err.Error()), MessageError)
+				errorMessage := fmt.Sprintf("cannot delete log file '%s': %s", s.Conf.LogPath, err)
+				s.runner.SendMessage(s.Name, errorMessage, MessageError)
+				failures = append(failures, errorMessage)
 			} else {
 				s.runner.SendMessage(s.Name, "Deleted", MessageSuccess)
 			}
@@ -174,104 +764,792 @@ func (s *Service) DeleteFiles(removeWorkingDirectory bool) error {
 		if s.Conf.WorkingDirectory != s.remoteHomeDir {
 			s.runner.SendMessage(s.Name, fmt.Sprintf("Deleting service working directory '%s'", s.Conf.WorkingDirectory), MessageNormal)
 			err := s.DeleteDirIfEmpty(s.Conf.WorkingDirectory)
-			if err, ok := err.(*sftp.StatusError); ok {
-				switch err.Code {
-				case 4: // sshFxFailure
-					s.runner.SendMessage(s.Name, fmt.Sprintf("Cannot delete service working directory '%s': directory is not empty", s.Conf.WorkingDirectory), MessageError)
-				default:
-					s.runner.SendMessage(s.Name, fmt.Sprintf("Cannot delete service working directory '%s': %s", s.Conf.WorkingDirectory, err.Error()), MessageError)
-				}
+			if statusErr, ok := err.(*sftp.StatusError); ok && statusErr.Code == 4 { // sshFxFailure
+				err = errors.New("directory is not empty")
+			}
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			if err != nil {
+				errorMessage := fmt.Sprintf("cannot delete service working directory '%s': %s", s.Conf.WorkingDirectory, err)
+				s.runner.SendMessage(s.Name, errorMessage, MessageError)
+				failures = append(failures, errorMessage)
+			} else {
+				s.runner.SendMessage(s.Name, "Deleted", MessageSuccess)
 			}
-			s.runner.SendMessage(s.Name, "Deleted", MessageSuccess)
 		}
 	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
 	return nil
 }
 
-func (s *Service) ShowServiceFile() {
+func (s *Service) ShowServiceFile() error {
 	var buf bytes.Buffer
-	s.GenerateServiceFile(&buf)
+	if err := s.GenerateServiceFile(&buf); err != nil {
+		s.runner.SendMessage(s.Name, err.Error(), MessageError)
+		return err
+	}
 	s.runner.SendMessage(s.Name, buf.String(), MessageNormal)
+	return nil
+}
+
+func (s *Service) CatServiceFile() error {
+	content, err := s.ReadUnitServiceFile()
+	if err != nil {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("cannot read service file `%s`: %s", s.serviceFilePath(), err), MessageError)
+		return err
+	}
+	s.runner.SendMessage(s.Name, content, MessageNormal)
+	if !s.isManagedServiceFile(content) {
+		s.runner.SendMessage(s.Name, "service file not written by god", MessageWarning)
+	}
+	return nil
+}
+
+// OrphanedServices returns the names of the services installed by god in the
+// services directory on the remote host that are not in the configuration
+// file anymore.
+func (s *Service) OrphanedServices() ([]string, error) {
+	pattern := filepath.Join(s.Conf.SystemdServicesDirectory, fmt.Sprintf(s.initSystem().serviceFileName, "*"))
+	// grep exits with 1 if no file matches, 2 on errors
+	output, err := s.Exec(fmt.Sprintf("grep -h '^%s' %s 2>/dev/null; test $? -lt 2", managedMarker, pattern))
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	for _, line := range strings.Split(output, "\n") {
+		name := strings.TrimSpace(strings.TrimPrefix(line, managedMarker))
+		if name == "" || name == line {
+			continue
+		}
+		if !s.runner.isUnitName(name) && !slices.Contains(orphans, name) {
+			orphans = append(orphans, name)
+		}
+	}
+	return orphans, nil
+}
+
+// isUnitName reports whether name is the unit name of a service in the
+// configuration file.
+func (r *Runner) isUnitName(name string) bool {
+	for serviceName, conf := range r.conf {
+		if conf.UnitName == name || conf.UnitName == "" && serviceName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveOrphanedService stops, disables and removes the service name
+// installed on the remote host by god, using the connection and the
+// configuration of s.
+func (s *Service) RemoveOrphanedService(name string) error {
+	orphan := *s
+	orphan.Name = name
+	conf := *s.Conf
+	conf.CopyFiles = nil
+	conf.ExtraInstalls = nil
+	conf.UnitName = ""
+	conf.RunMode = ""
+	orphan.Conf = &conf
+	content, err := orphan.ReadUnitServiceFile()
+	if err != nil {
+		s.runner.SendMessage(name, err.Error(), MessageError)
+		return err
+	}
+	if !orphan.isManagedServiceFile(content) {
+		err := fmt.Errorf("service file `%s` is not managed by god", orphan.serviceFilePath())
+		s.runner.SendMessage(name, err.Error(), MessageError)
+		return err
+	}
+	// The executable is removed only if installed by go install. Only systemd
+	// unit files are parsed for the executable path.
+	conf.ExecStart = ""
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, "ExecStart=") {
+			conf.ExecStart = execPath(strings.TrimPrefix(line, "ExecStart="))
+		}
+	}
+	orphan.StopService()
+	orphan.DisableService()
+	if err := orphan.DeleteServiceFile(); err != nil {
+		return err
+	}
+	orphan.ReloadDaemon()
+	orphan.ResetFailedServices()
+	if conf.ExecStart != "" && filepath.Dir(conf.ExecStart) == conf.GoBinDirectory {
+		users, err := s.executableUsers(conf.ExecStart)
+		if err != nil {
+			s.runner.SendMessage(name, fmt.Sprintf("Executable `%s` not deleted: cannot check if configured services use it: %s", conf.ExecStart, err), MessageWarning)
+			return nil
+		}
+		if len(users) > 0 {
+			s.runner.SendMessage(name, fmt.Sprintf("Executable `%s` not deleted: used by `%s`", conf.ExecStart, strings.Join(users, "`, `")), MessageNormal)
+			return nil
+		}
+		return orphan.DeleteExecutable()
+	}
+	return nil
+}
+
+// executableUsers returns the names of the services in the configuration file
+// with the same host of s whose executable, or one of the extra_installs
+// executables, is path.
+func (s *Service) executableUsers(path string) ([]string, error) {
+	serviceNames := make([]string, 0, len(s.runner.conf))
+	for serviceName := range s.runner.conf {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	slices.Sort(serviceNames)
+	var users []string
+	for _, serviceName := range serviceNames {
+		conf, err := s.runner.ResolveConf(serviceName)
+		if err != nil {
+			return nil, err
+		}
+		if conf.Host != s.Conf.Host || conf.Port != s.Conf.Port {
+			continue
+		}
+		service, err := s.runner.MakeService(serviceName)
+		if err != nil {
+			return nil, err
+		}
+		if service.installedExecutable() == path || slices.Contains(service.extraExecutables(), path) {
+			users = append(users, serviceName)
+		}
+	}
+	return users, nil
+}
+
+// RunCommand runs cmd verbatim on the remote host in the service working
+// directory, with the service environment. If stdin is not nil, the standard
+// input of cmd reads from it.
+func (s *Service) RunCommand(cmd string, stdin io.Reader) error {
+	s.runner.SendMessage(s.Name, cmd, MessageNormal)
+	output, err := s.ExecInput(s.contextPrefix()+cmd, stdin)
+	if err != nil {
+		s.runner.SendMessage(s.Name, output, MessageError)
+		return err
+	}
+	s.runner.SendMessage(s.Name, output, MessageSuccess)
+	return nil
+}
+
+// RunTemplateCommand is like RunCommand, but the configuration variables in
+// cmd are replaced like in ParseCommand, ex: `cat {{.LogPath}}`.
+func (s *Service) RunTemplateCommand(cmd string, stdin io.Reader) error {
+	cmd, err := s.ParseCommand(cmd)
+	if err != nil {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("invalid command template: %s", err), MessageError)
+		return err
+	}
+	return s.RunCommand(cmd, stdin)
+}
+
+// contextPrefix returns the shell commands that enter the working directory of
+// the service and export its environment, to be prepended to a command so that
+// it runs in the same context as the service.
+func (s *Service) contextPrefix() string {
+	prefix := fmt.Sprintf("cd %s && ", shellQuote(s.Conf.WorkingDirectory))
+	if s.Conf.Environment != "" {
+		prefix += fmt.Sprintf("export %s && ", shellEnvironment(s.Conf.Environment))
+	}
+	return prefix
+}
+
+// Shell opens an interactive login shell on the remote host, in the working
+// directory of the service and with its environment, connected to the local
+// terminal. Returns when the shell exits.
+func (s *Service) Shell() error {
+	size, err := terminalSize(os.Stdin)
+	if err != nil {
+		return errors.New("the shell command needs a terminal")
+	}
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	resize, stop := notifyResize(os.Stdin)
+	defer stop()
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = "xterm"
+	}
+	cmd := s.contextPrefix() + `exec "${SHELL:-/bin/sh}" -l`
+	err = s.client.RunTerminal(cmd, term, size, resize, os.Stdin, os.Stdout, os.Stderr)
+	return remoteCommandError(cmd, "", err)
+}
+
+// Number of log lines printed by Logs if since is not set.
+const logsLines = 100
+
+// Logs prints the service logs: the log_path file if set, otherwise the
+// journal. since and priority, if set, filter the journal entries like the
+// journalctl --since and --priority options.
+func (s *Service) Logs(since, priority string) error {
+	var cmd string
+	switch {
+	case s.Conf.LogPath != "":
+		if since != "" || priority != "" {
+			s.runner.SendMessage(s.Name, "-since and -priority are ignored with log_path", MessageWarning)
+		}
+		cmd = fmt.Sprintf("tail -n %d %s", logsLines, s.Conf.LogPath)
+	case s.initSystem().logs != "":
+		cmd = s.initCommand(s.initSystem().logs)
+		if since != "" {
+			cmd += " --since " + shellQuote(since)
+		} else {
+			cmd += fmt.Sprintf(" -n %d", logsLines)
+		}
+		if priority != "" {
+			cmd += " --priority " + shellQuote(priority)
+		}
+	default:
+		err := fmt.Errorf("logs are not available with %s: please set `log_path` in `%s` file", s.Conf.InitSystem, s.runner.confFilePath)
+		s.runner.SendMessage(s.Name, err.Error(), MessageError)
+		return err
+	}
+	s.runner.SendMessage(s.Name, cmd, MessageNormal)
+	output, err := s.Exec(cmd)
+	if err != nil {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("cannot read logs: %s", output), MessageError)
+		return err
+	}
+	s.runner.SendMessage(s.Name, output, MessageNormal)
+	return nil
 }
 
 func (s *Service) DeleteServiceFile() error {
-	filename := filepath.Join(s.Conf.SystemdServicesDirectory, fmt.Sprintf("%s.service", s.Name))
+	filename := s.serviceFilePath()
 	errorMessage := fmt.Sprintf("cannot delete service file `%s`", filename)
+	if s.initSystem().serviceDirectory {
+		return s.PrintExec(fmt.Sprintf("rm -r %s", filepath.Dir(filename)), errorMessage)
+	}
 	return s.PrintExec(fmt.Sprintf("rm %s", filename), errorMessage)
 }
 
 func (s *Service) ReloadDaemon() error {
-	return s.PrintExec("systemctl --user daemon-reload", "couldn't reload systemd daemon")
+	return s.printInitExec(s.initSystem().reload, "couldn't reload systemd daemon")
 }
 
 func (s *Service) ResetFailedServices() error {
-	return s.PrintExec("systemctl --user reset-failed", "couldn't reset failed systemd services")
+	return s.printInitExec(s.initSystem().resetFailed, "couldn't reset failed systemd services")
 }
 
 func (s *Service) EnableService() error {
-	return s.PrintExec(fmt.Sprintf("systemctl --user enable %s", s.Name), "couldn't enable systemd service")
+	return s.printInitExec(s.initSystem().enable, "couldn't enable service")
 }
 
 func (s *Service) DisableService() error {
-	return s.PrintExec(fmt.Sprintf("systemctl --user disable %s", s.Name), "couldn't disable systemd service")
+	return s.printInitExec(s.initSystem().disable, "couldn't disable service")
+}
+
+// CheckDrift warns if the installed unit service file is out of date with the
+// configuration. In strict drift mode it is an error.
+func (s *Service) CheckDrift() error {
+	changed, err := s.UnitServiceFileChanged()
+	if err != nil || !changed {
+		return nil
+	}
+	message := "installed unit is out of date: run `god install` to update it"
+	if s.runner.StrictDrift {
+		s.runner.SendMessage(s.Name, message, MessageError)
+		return errors.New(message)
+	}
+	s.runner.SendMessage(s.Name, message, MessageWarning)
+	return nil
 }
 
 func (s *Service) StartService() error {
-	return s.PrintExec(fmt.Sprintf("systemctl --user start %s", s.Name), "couldn't start systemd service")
+	if err := s.CheckDrift(); err != nil {
+		return err
+	}
+	if err := s.printInitExec(s.initSystem().start, "couldn't start service"); err != nil {
+		return err
+	}
+	return s.WaitReady()
 }
 
 func (s *Service) StopService() error {
-	return s.PrintExec(fmt.Sprintf("systemctl --user stop %s", s.Name), "couldn't stop systemd service")
+	return s.printInitExec(s.initSystem().stop, "couldn't stop service")
 }
 
 func (s *Service) RestartService() error {
-	return s.PrintExec(fmt.Sprintf("systemctl --user restart %s", s.Name), "couldn't restart systemd service")
+	if err := s.CheckDrift(); err != nil {
+		return err
+	}
+	if err := s.printInitExec(s.initSystem().restart, "couldn't restart service"); err != nil {
+		return err
+	}
+	return s.WaitReady()
 }
 
-func (s *Service) StatusService() error {
-	return s.PrintExec(fmt.Sprintf("systemctl --user status %s", s.Name), "")
+// Interval between the checks of WaitReady.
+const readyPollInterval = time.Second
+
+// WaitReady waits for a notify or forking service to be reported active by
+// systemd, that is for the service to signal its readiness, for at most
+// ready_timeout_sec seconds. It fails if the service leaves the activating
+// state without becoming active. Other services are not waited.
+func (s *Service) WaitReady() error {
+	if s.Conf.ServiceType != "notify" && s.Conf.ServiceType != "forking" {
+		return nil
+	}
+	timeout := time.Duration(s.Conf.ReadyTimeoutSec) * time.Second
+	deadline := time.Now().Add(timeout)
+	for {
+		active, state, err := s.IsActive()
+		if err != nil {
+			s.runner.SendMessage(s.Name, state, MessageError)
+			return err
+		}
+		if active {
+			s.runner.SendMessage(s.Name, "Ready", MessageSuccess)
+			return nil
+		}
+		if state != "activating" && state != "reloading" {
+			err = fmt.Errorf("service is %s", state)
+			s.runner.SendMessage(s.Name, fmt.Sprintf("service not ready: %s", state), MessageError)
+			return err
+		}
+		if time.Now().Add(readyPollInterval).After(deadline) {
+			err = fmt.Errorf("service still %s after %s", state, timeout)
+			s.runner.SendMessage(s.Name, err.Error(), MessageError)
+			return err
+		}
+		select {
+		case <-time.After(readyPollInterval):
+		case <-s.runContext().Done():
+			return s.runContext().Err()
+		}
+	}
 }
 
-func (s *Service) Install(createWorkingDirectory bool) error {
-	if err := s.CheckGo(); err != nil {
+// Time waited after a restart before checking that the service is still
+// active.
+const restartSettleTime = 2 * time.Second
+
+// RestartServiceAndCheck restarts the service and checks that it is still
+// active after a while, failing if it exited or is restarting.
+func (s *Service) RestartServiceAndCheck() error {
+	if err := s.RestartService(); err != nil {
 		return err
 	}
-	if err := s.CheckSystemd(); err != nil {
+	select {
+	case <-time.After(restartSettleTime):
+	case <-s.runContext().Done():
+		return s.runContext().Err()
+	}
+	active, state, err := s.IsActive()
+	if err == nil && !active {
+		err = fmt.Errorf("service is %s", state)
+	}
+	if err != nil {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("service not active after restart: %s", state), MessageError)
 		return err
 	}
-	if err := s.CheckLingering(); err != nil {
+	s.runner.SendMessage(s.Name, "Active", MessageSuccess)
+	return nil
+}
+
+func (s *Service) StatusService() error {
+	return s.printInitExec(s.initSystem().status, "")
+}
+
+// IsActive reports whether the service is active, along with the state
+// returned by the init system, ex: `systemctl --user is-active`.
+func (s *Service) IsActive() (bool, string, error) {
+	state, err := s.Exec(s.initCommand(s.initSystem().isActive))
+	if err != nil {
+		return false, state, err
+	}
+	return state == "active", state, nil
+}
+
+// IsEnabled reports whether the service is enabled, along with the state
+// returned by the init system, ex: `systemctl --user is-enabled`.
+func (s *Service) IsEnabled() (bool, string, error) {
+	state, err := s.Exec(s.initCommand(s.initSystem().isEnabled))
+	if err != nil {
+		return false, state, err
+	}
+	return slices.Contains([]string{"enabled", "enabled-runtime", "static", "alias", "indirect", "generated", "transient"}, state), state, nil
+}
+
+func (s *Service) CheckActive() error {
+	return s.printState(s.IsActive())
+}
+
+func (s *Service) CheckEnabled() error {
+	return s.printState(s.IsEnabled())
+}
+
+func (s *Service) printState(ok bool, state string, err error) error {
+	if err != nil {
+		s.runner.SendMessage(s.Name, state, MessageError)
 		return err
 	}
-	if err := s.CheckWorkingDir(createWorkingDirectory); err != nil {
+	if !ok {
+		s.runner.SendMessage(s.Name, state, MessageError)
+		return fmt.Errorf("service is %s", state)
+	}
+	s.runner.SendMessage(s.Name, state, MessageSuccess)
+	return nil
+}
+
+// printInitExec runs the init system cmd with PrintExec. If the init system
+// does not need cmd, it does nothing.
+func (s *Service) printInitExec(cmd, errorMessage string) error {
+	cmd = s.initCommand(cmd)
+	if cmd == "" {
+		return nil
+	}
+	return s.PrintExec(cmd, errorMessage)
+}
+
+// RunPostInstall runs the post_install command on the remote host. If it fails,
+// a warning is printed, or an error is returned if post_install_required is
+// set.
+func (s *Service) RunPostInstall() error {
+	if s.Conf.PostInstall == "" {
+		return nil
+	}
+	cmd, err := s.ParseCommand(s.Conf.PostInstall)
+	if err != nil {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("invalid `post_install`: %s", err), MessageError)
 		return err
 	}
-	if err := s.AuthPrivateRepo(); err != nil {
+	s.runner.SendMessage(s.Name, cmd, MessageNormal)
+	output, err := s.Exec(cmd)
+	if err != nil {
+		errorMessage := fmt.Sprintf("post_install failed: %s", output)
+		if s.Conf.PostInstallRequired {
+			s.runner.SendMessage(s.Name, errorMessage, MessageError)
+			return err
+		}
+		s.runner.SendMessage(s.Name, errorMessage, MessageWarning)
+		return nil
+	}
+	s.runner.SendMessage(s.Name, output, MessageSuccess)
+	return nil
+}
+
+func (s *Service) Install(createWorkingDirectory bool) error {
+	if err := s.install(createWorkingDirectory); err != nil {
 		return err
 	}
-	if err := s.InstallExecutable(); err != nil {
+	if s.Conf.PostInstall != "" && s.simulated("RunPostInstall") {
+		return nil
+	}
+	return s.RunPostInstall()
+}
+
+// Reinstall updates the installed service in place: after the install checks
+// it stops the service, installs the executable, the copied files and the
+// service file over the current ones and starts the service again. Unlike
+// uninstall and install, the service stays registered, enabled or not as it
+// is, and the working directory is kept, so the downtime is just a restart. If
+// the install fails after the service is stopped, the service is started
+// again.
+func (s *Service) Reinstall(createWorkingDirectory bool) error {
+	var steps []serviceStep
+	stopped := false
+	for _, step := range s.installSteps(createWorkingDirectory) {
+		switch step.name {
+		case "InstallExecutable":
+			steps = append(steps, serviceStep{"StopService", func() error {
+				err := s.StopService()
+				stopped = err == nil
+				return err
+			}})
+		case "EnableService":
+			continue
+		}
+		steps = append(steps, step)
+	}
+	if err := s.runSteps(steps); err != nil {
+		if stopped {
+			s.step("StartService", s.StartService)
+		}
 		return err
 	}
-	if err := s.CopyFiles(); err != nil {
+	if err := s.step("StartService", s.StartService); err != nil {
 		return err
 	}
-	if err := s.CreateServiceFile(); err != nil {
+	return s.RunPostInstall()
+}
+
+// serviceStep is a named step of a service command, run with Service.step.
+type serviceStep struct {
+	name string
+	fn   func() error
+}
+
+// installSteps returns the steps of install, in order.
+func (s *Service) installSteps(createWorkingDirectory bool) []serviceStep {
+	return []serviceStep{
+		{"RunPreBuild", s.RunPreBuild},
+		{"CheckCopyFiles", s.CheckCopyFiles},
+		{"CheckGo", s.CheckGo},
+		{"CheckSystemd", s.CheckSystemd},
+		{"CheckLingering", s.CheckLingering},
+		{"CheckDependencies", s.CheckDependencies},
+		{"CheckDiskSpace", s.CheckDiskSpace},
+		{"CheckWorkingDir", func() error { return s.CheckWorkingDir(createWorkingDirectory) }},
+		{"AuthPrivateRepo", s.AuthPrivateRepo},
+		{"InstallExecutable", s.InstallExecutable},
+		{"KeepRelease", s.KeepRelease},
+		{"CopyFiles", s.CopyFiles},
+		{"CreateServiceFile", s.CreateServiceFile},
+		{"ReloadDaemon", s.ReloadDaemon},
+		{"EnableService", s.enableServiceOnInstall},
+	}
+}
+
+func (s *Service) install(createWorkingDirectory bool) error {
+	return s.runSteps(s.installSteps(createWorkingDirectory))
+}
+
+// runSteps runs steps in order, stopping at the first that fails.
+func (s *Service) runSteps(steps []serviceStep) error {
+	for _, step := range steps {
+		if err := s.step(step.name, step.fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enableServiceOnInstall enables the service, unless it must not be enabled on
+// install.
+func (s *Service) enableServiceOnInstall() error {
+	if !s.enableOnInstall() {
+		s.runner.SendMessage(s.Name, "Not enabled at boot: start it with `god start`", MessageNormal)
+		return nil
+	}
+	return s.EnableService()
+}
+
+// enableOnInstall reports whether install enables the service. The
+// enable_on_install configuration, if set, takes precedence over the runner
+// NoEnable option.
+func (s *Service) enableOnInstall() bool {
+	if s.Conf.EnableOnInstall != nil {
+		return *s.Conf.EnableOnInstall
+	}
+	return !s.runner.NoEnable
+}
+
+// Ensure brings the service to the desired state performing only the needed
+// steps: install it if missing, otherwise run the install steps skipping the
+// ones whose inputs did not change, so that the executable, the copied files
+// and the unit service file are updated only if changed and the service is
+// enabled only if not already, then start or restart it. The post_install
+// command is run only if something was installed or updated.
+func (s *Service) Ensure(createWorkingDirectory bool) error {
+	_, err := s.ReadUnitServiceFile()
+	if err != nil {
+		if err := s.install(createWorkingDirectory); err != nil {
+			return err
+		}
+		if err := s.StartService(); err != nil {
+			return err
+		}
+		return s.RunPostInstall()
+	}
+
+	var executableChanged, filesChanged, unitChanged, enabledChanged bool
+	steps := s.installSteps(createWorkingDirectory)
+	for i := range steps {
+		switch steps[i].name {
+		case "InstallExecutable":
+			steps[i].fn = func() error {
+				checksum := s.executableChecksum()
+				if err := s.InstallExecutable(); err != nil {
+					return err
+				}
+				executableChanged = checksum == "" || checksum != s.executableChecksum()
+				return nil
+			}
+		case "KeepRelease":
+			steps[i].fn = func() error {
+				if !executableChanged {
+					return nil
+				}
+				return s.KeepRelease()
+			}
+		case "CopyFiles":
+			steps[i].fn = func() error {
+				filesChanged = s.copyFilesChanged()
+				if !filesChanged {
+					return s.chownCopiedFiles()
+				}
+				return s.CopyFiles()
+			}
+		case "CreateServiceFile":
+			steps[i].fn = func() error {
+				unitChanged, err = s.UnitServiceFileChanged()
+				if err != nil {
+					s.runner.SendMessage(s.Name, err.Error(), MessageError)
+					return err
+				}
+				if !unitChanged {
+					return nil
+				}
+				return s.CreateServiceFile()
+			}
+		case "ReloadDaemon":
+			steps[i].fn = func() error {
+				if !unitChanged {
+					return nil
+				}
+				return s.ReloadDaemon()
+			}
+		case "EnableService":
+			steps[i].fn = func() error {
+				if !s.enableOnInstall() {
+					return nil
+				}
+				enabled, _, err := s.IsEnabled()
+				if err != nil {
+					s.runner.SendMessage(s.Name, err.Error(), MessageError)
+					return err
+				}
+				if enabled {
+					return nil
+				}
+				enabledChanged = true
+				return s.EnableService()
+			}
+		}
+	}
+	if err := s.runSteps(steps); err != nil {
 		return err
 	}
-	if err := s.ReloadDaemon(); err != nil {
+
+	changed := executableChanged || filesChanged || unitChanged
+	active, _, err := s.IsActive()
+	if err != nil {
+		s.runner.SendMessage(s.Name, err.Error(), MessageError)
 		return err
 	}
-	if err := s.EnableService(); err != nil {
+	switch {
+	case !active:
+		err = s.StartService()
+	case changed:
+		err = s.RestartService()
+	case !enabledChanged:
+		s.runner.SendMessage(s.Name, "Already up to date", MessageSuccess)
+	}
+	if err != nil {
 		return err
 	}
+	if changed {
+		return s.RunPostInstall()
+	}
 	return nil
 }
 
-func (s *Service) Uninstall(removeWorkingDirectory bool) {
-	s.StopService()
-	s.DisableService()
-	s.DeleteServiceFile()
-	s.ReloadDaemon()
-	s.ResetFailedServices()
-	s.DeleteExecutable()
-	s.DeleteFiles(removeWorkingDirectory)
+// executableChecksum returns the checksum of the service executable on the
+// remote host, or an empty string if it cannot be computed or in go-run mode,
+// where there is no installed executable.
+func (s *Service) executableChecksum() string {
+	executable := s.installedExecutable()
+	if executable == "" {
+		return ""
+	}
+	output, err := s.Exec(fmt.Sprintf("sha256sum %s", shellQuote(executable)))
+	if err != nil {
+		return ""
+	}
+	return strings.Fields(output + " ")[0]
+}
+
+// Uninstall stops, disables and removes the service from the remote host. All
+// steps are run even if some fail, so that as much as possible is removed.
+// Returns an error naming the failed steps and wrapping the first error.
+func (s *Service) Uninstall(removeWorkingDirectory bool) error {
+	steps := []serviceStep{
+		{"StopService", s.StopService},
+		{"DisableService", s.DisableService},
+		{"DeleteServiceFile", s.DeleteServiceFile},
+		{"ReloadDaemon", s.ReloadDaemon},
+		{"ResetFailedServices", s.ResetFailedServices},
+		{"DeleteExecutable", s.DeleteExecutable},
+		{"DeleteFiles", func() error { return s.DeleteFiles(removeWorkingDirectory) }},
+		{"VerifyUninstalled", s.VerifyUninstalled},
+	}
+	var failed []string
+	var firstErr error
+	for _, step := range steps {
+		if err := s.step(step.name, step.fn); err != nil {
+			failed = append(failed, step.name)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("uninstall steps failed: %s: %w", strings.Join(failed, ", "), firstErr)
+	}
+	return nil
+}
+
+// Steps that do not change the local or the remote host. They are the only
+// steps run in dry-run mode.
+var readOnlySteps = map[string]bool{
+	"CheckCopyFiles":    true,
+	"CheckGo":           true,
+	"CheckSystemd":      true,
+	"CheckLingering":    true,
+	"CheckDependencies": true,
+	"CheckDiskSpace":    true,
+	"VerifyUninstalled": true,
+}
+
+// simulated reports whether the step name must not be run because the runner
+// is in dry-run mode and the step is not read-only. In dry-run mode, it prints
+// whether the step is run or simulated.
+func (s *Service) simulated(name string) bool {
+	if !s.runner.DryRun {
+		return false
+	}
+	if readOnlySteps[name] {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("[run] %s", name), MessageNormal)
+		return false
+	}
+	s.runner.SendMessage(s.Name, fmt.Sprintf("[simulated] %s", name), MessageNormal)
+	return true
+}
+
+// step runs the step fn named name and records its duration. The duration is
+// printed in verbose mode, or if the service verbose option is set, or as a
+// warning if longer than the runner SlowStepThreshold. In dry-run mode, only
+// read-only steps are run.
+func (s *Service) step(name string, fn func() error) error {
+	if s.simulated(name) {
+		return nil
+	}
+	s.runner.send(message{serviceName: s.Name, status: MessageNormal, step: name, kind: EventStepStart})
+	s.runner.setStep(s.Name, name)
+	start := time.Now()
+	err := fn()
+	duration := time.Since(start).Round(time.Millisecond)
+	s.runner.setStep(s.Name, "")
+	if err != nil {
+		s.runner.send(message{serviceName: s.Name, text: err.Error(), status: MessageError, step: name, kind: EventStepError})
+	} else {
+		s.runner.send(message{serviceName: s.Name, status: MessageSuccess, step: name, kind: EventStepSuccess})
+	}
+	s.runner.recordStep(s.Name, name, duration)
+	switch {
+	case s.runner.SlowStepThreshold > 0 && duration > s.runner.SlowStepThreshold:
+		s.runner.SendMessage(s.Name, fmt.Sprintf("%s took %s, more than %s", name, duration, s.runner.SlowStepThreshold), MessageWarning)
+	case s.runner.Verbose || s.Conf.Verbose:
+		s.runner.SendMessage(s.Name, fmt.Sprintf("%s took %s", name, duration), MessageNormal)
+	}
+	return err
 }
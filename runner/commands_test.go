@@ -0,0 +1,57 @@
+package runner
+
+import "testing"
+
+func TestIsRetryableInstallError(t *testing.T) {
+	tests := []struct {
+		output string
+		want   bool
+	}{
+		{"go: example.com/app@latest: Get \"https://proxy.golang.org/...\": dial tcp: i/o timeout", true},
+		{"go: example.com/app@latest: reading https://proxy.golang.org/...: 503 Service Unavailable", true},
+		{"go: example.com/app@latest: reading https://proxy.golang.org/...: 404 Not Found", false},
+		{"fatal: could not read Username for 'https://github.com': terminal prompts disabled", false},
+		{"# example.com/app\n./main.go:10:2: undefined: foo", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := isRetryableInstallError(test.output); got != test.want {
+			t.Errorf("isRetryableInstallError(%q) = %v, want %v", test.output, got, test.want)
+		}
+	}
+}
+
+func TestExecutableChecksum(t *testing.T) {
+	server := startTestServer(t)
+	r := makeTestRunner(t, `app:
+  user: god
+  host: 127.0.0.1
+  port: `+server.port+`
+  private_key_path: {{key}}
+  go_install: example.com/app@latest
+  exec_start: /home/god/go/bin/app -config /home/god/app.yml
+go_run:
+  user: god
+  host: 127.0.0.1
+  port: `+server.port+`
+  private_key_path: {{key}}
+  go_install: example.com/app@latest
+  run_mode: go-run
+`)
+	service, err := r.MakeService("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum := service.executableChecksum(); checksum != "0123abcd" {
+		t.Errorf("got checksum %q, want 0123abcd", checksum)
+	}
+
+	// In go-run mode there is no installed executable to hash
+	service, err = r.MakeService("go_run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum := service.executableChecksum(); checksum != "" {
+		t.Errorf("go-run: got checksum %q, want none", checksum)
+	}
+}
@@ -0,0 +1,163 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// evalCondition evaluates the boolean expression expr over the local
+// environment variables. Operands are variables ($VAR or ${VAR}), quoted
+// strings or bare words; operators are ==, !=, !, && and ||, with parentheses
+// for grouping. A single operand is true if it is not empty, `false` or `0`.
+func evalCondition(expr string) (bool, error) {
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return false, err
+	}
+	p := &conditionParser{tokens: tokens}
+	value, err := p.or()
+	if err != nil {
+		return false, err
+	}
+	if p.pos < len(p.tokens) {
+		return false, fmt.Errorf("unexpected `%s`", p.tokens[p.pos].text)
+	}
+	return value.bool(), nil
+}
+
+type conditionToken struct {
+	text    string
+	operand bool
+}
+
+func tokenizeCondition(expr string) ([]conditionToken, error) {
+	var tokens []conditionToken
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.HasPrefix(string(runes[i:]), "==") || strings.HasPrefix(string(runes[i:]), "!=") || strings.HasPrefix(string(runes[i:]), "&&") || strings.HasPrefix(string(runes[i:]), "||"):
+			tokens = append(tokens, conditionToken{text: string(runes[i : i+2])})
+			i += 2
+		case c == '!' || c == '(' || c == ')':
+			tokens = append(tokens, conditionToken{text: string(c)})
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexRune(string(runes[i+1:]), c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string %s", string(runes[i:]))
+			}
+			value := string(runes[i+1:])[:end]
+			tokens = append(tokens, conditionToken{text: value, operand: true})
+			i += len([]rune(value)) + 2
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("=!&|()\"'", runes[i]) {
+				i++
+			}
+			if start == i {
+				return nil, fmt.Errorf("unexpected `%c`", c)
+			}
+			tokens = append(tokens, conditionToken{text: os.ExpandEnv(string(runes[start:i])), operand: true})
+		}
+	}
+	return tokens, nil
+}
+
+// conditionValue is the value of an operand or of a boolean expression.
+type conditionValue struct {
+	text      string
+	isBool    bool
+	boolValue bool
+}
+
+func (v conditionValue) bool() bool {
+	if v.isBool {
+		return v.boolValue
+	}
+	return v.text != "" && v.text != "false" && v.text != "0"
+}
+
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+}
+
+func (p *conditionParser) peek(text string) bool {
+	return p.pos < len(p.tokens) && !p.tokens[p.pos].operand && p.tokens[p.pos].text == text
+}
+
+func (p *conditionParser) or() (conditionValue, error) {
+	left, err := p.and()
+	for err == nil && p.peek("||") {
+		p.pos++
+		var right conditionValue
+		right, err = p.and()
+		left = conditionValue{isBool: true, boolValue: left.bool() || right.bool()}
+	}
+	return left, err
+}
+
+func (p *conditionParser) and() (conditionValue, error) {
+	left, err := p.not()
+	for err == nil && p.peek("&&") {
+		p.pos++
+		var right conditionValue
+		right, err = p.not()
+		left = conditionValue{isBool: true, boolValue: left.bool() && right.bool()}
+	}
+	return left, err
+}
+
+func (p *conditionParser) not() (conditionValue, error) {
+	if p.peek("!") {
+		p.pos++
+		value, err := p.not()
+		return conditionValue{isBool: true, boolValue: !value.bool()}, err
+	}
+	return p.comparison()
+}
+
+func (p *conditionParser) comparison() (conditionValue, error) {
+	left, err := p.operand()
+	if err != nil {
+		return left, err
+	}
+	if p.peek("==") || p.peek("!=") {
+		equal := p.tokens[p.pos].text == "=="
+		p.pos++
+		right, err := p.operand()
+		if err != nil {
+			return left, err
+		}
+		return conditionValue{isBool: true, boolValue: (left.text == right.text) == equal}, nil
+	}
+	return left, nil
+}
+
+func (p *conditionParser) operand() (conditionValue, error) {
+	if p.pos >= len(p.tokens) {
+		return conditionValue{}, fmt.Errorf("unexpected end of expression")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	if token.operand {
+		return conditionValue{text: token.text}, nil
+	}
+	if token.text != "(" {
+		return conditionValue{}, fmt.Errorf("unexpected `%s`", token.text)
+	}
+	value, err := p.or()
+	if err != nil {
+		return value, err
+	}
+	if !p.peek(")") {
+		return value, fmt.Errorf("missing `)`")
+	}
+	p.pos++
+	return value, nil
+}
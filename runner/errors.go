@@ -0,0 +1,96 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrServiceNotFound is matched by the errors returned for services missing
+	// in the configuration file.
+	ErrServiceNotFound = errors.New("service not found")
+	// ErrConfigInvalid is matched by the errors returned for a configuration
+	// file that cannot be parsed or has invalid values.
+	ErrConfigInvalid = errors.New("invalid configuration")
+)
+
+// kindError is an error that keeps its message but matches kind with
+// errors.Is.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func configError(format string, a ...interface{}) error {
+	return &kindError{kind: ErrConfigInvalid, err: fmt.Errorf(format, a...)}
+}
+
+// RemoteCommandError is returned when a command run on the remote host exits
+// with a non-zero status.
+type RemoteCommandError struct {
+	// The command run on the remote host
+	Command string
+	// The exit status of the command
+	ExitCode int
+	// The standard error of the command
+	Output string
+
+	err error
+}
+
+func (e *RemoteCommandError) Error() string {
+	return e.err.Error()
+}
+
+func (e *RemoteCommandError) Unwrap() error {
+	return e.err
+}
+
+// remoteCommandError returns a RemoteCommandError for err if the remote
+// command cmd exited with a non-zero status, otherwise err.
+func remoteCommandError(cmd, output string, err error) error {
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	return &RemoteCommandError{Command: cmd, ExitCode: exitErr.ExitStatus(), Output: output, err: err}
+}
+
+// ServicesError collects the errors of a run over many services, keyed by
+// service name. Use the single errors to check the failure kinds.
+type ServicesError map[string]error
+
+func (e ServicesError) Error() string {
+	names := e.ServiceNames()
+	messages := make([]string, 0, len(names))
+	for _, name := range names {
+		messages = append(messages, fmt.Sprintf("%s: %s", name, e[name]))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// ServiceNames returns the sorted names of the failed services.
+func (e ServicesError) ServiceNames() []string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,216 @@
+package runner
+
+import "strings"
+
+// initSystem describes how services are managed by an init system on the
+// remote host. Commands are parsed with ParseCommand, then %[1]s is replaced
+// with the unit name of the service. An empty command means the step is not
+// needed by the init system.
+type initSystem struct {
+	// Default directory of the service files. If empty, it is computed on the
+	// remote host.
+	servicesDirectory string
+	// Service file name relative to the services directory
+	serviceFileName string
+	// Template of the service file. %[1]s is replaced with the unit name and
+	// %[2]s with the line marking the file as written by god.
+	serviceTemplate string
+	// Whether the service file must be executable
+	executable bool
+	// Whether the service lives in its own directory inside the services
+	// directory
+	serviceDirectory bool
+	// Whether the user must be in the linger list
+	lingering bool
+	// Whether the service file resolves the %h and %u specifiers
+	specifiers bool
+
+	check, reload, resetFailed, enable, disable, start, stop, restart, status string
+	// Commands that print `active` or `enabled` if the service is
+	isActive, isEnabled string
+	// Command that prints the service logs. If empty, logs are available only
+	// with log_path.
+	logs string
+	// Command that prints `loaded` if the unit %[1]s exists. If empty, the
+	// run_after_service units are not checked.
+	unitLoaded string
+}
+
+var initSystems = map[string]initSystem{
+	"systemd": {
+		serviceFileName: "%s.service",
+		serviceTemplate: systemdServiceTemplate,
+		lingering:       true,
+		specifiers:      true,
+		check:           "{{.SystemdPath}} --version",
+		reload:          "systemctl --user daemon-reload",
+		resetFailed:     "systemctl --user reset-failed",
+		enable:          "systemctl --user enable %[1]s",
+		disable:         "systemctl --user disable %[1]s",
+		start:           "systemctl --user start %[1]s",
+		stop:            "systemctl --user stop %[1]s",
+		restart:         "systemctl --user restart %[1]s",
+		status:          "systemctl --user status %[1]s",
+		isActive:        "systemctl --user is-active %[1]s || true",
+		isEnabled:       "systemctl --user is-enabled %[1]s || true",
+		logs:            "journalctl --user -u %[1]s --no-pager",
+		unitLoaded:      "systemctl --user show -p LoadState --value %[1]s",
+	},
+	"openrc": {
+		servicesDirectory: "/etc/init.d",
+		serviceFileName:   "%s",
+		serviceTemplate:   openrcServiceTemplate,
+		executable:        true,
+		check:             "openrc --version",
+		enable:            "rc-update add %[1]s default",
+		disable:           "rc-update del %[1]s default",
+		start:             "rc-service %[1]s start",
+		stop:              "rc-service %[1]s stop",
+		restart:           "rc-service %[1]s restart",
+		status:            "rc-service %[1]s status",
+		isActive:          "rc-service %[1]s status >/dev/null 2>&1 && echo active || echo inactive",
+		isEnabled:         "rc-update show default | grep -qw %[1]s && echo enabled || echo disabled",
+	},
+	"runit": {
+		servicesDirectory: "/etc/sv",
+		serviceFileName:   "%s/run",
+		serviceTemplate:   runitServiceTemplate,
+		executable:        true,
+		serviceDirectory:  true,
+		check:             "command -v sv",
+		enable:            "ln -sfn {{.SystemdServicesDirectory}}/%[1]s /var/service/%[1]s",
+		disable:           "rm -f /var/service/%[1]s",
+		start:             "sv start %[1]s",
+		stop:              "sv stop %[1]s",
+		restart:           "sv restart %[1]s",
+		status:            "sv status %[1]s",
+		isActive:          "sv status %[1]s | grep -q '^run:' && echo active || echo inactive",
+		isEnabled:         "test -L /var/service/%[1]s && echo enabled || echo disabled",
+	},
+}
+
+// initSystem returns the init system used by the service.
+func (service *Service) initSystem() initSystem {
+	if init, found := initSystems[service.Conf.InitSystem]; found {
+		return init
+	}
+	return initSystems["systemd"]
+}
+
+// initCommand returns the command of the init system used by the service, or
+// an empty string if not needed.
+func (service *Service) initCommand(cmd string) string {
+	return service.unitCommand(cmd, service.unitName())
+}
+
+// unitCommand is like initCommand, but %[1]s is replaced with unit. The unit is
+// replaced after parsing, so it is never read as a template.
+func (service *Service) unitCommand(cmd, unit string) string {
+	if cmd == "" {
+		return ""
+	}
+	return strings.ReplaceAll(service.mustParseCommand(cmd), "%[1]s", unit)
+}
+
+// unitName returns the name of the service for the init system: unit_name if
+// set, or the service name.
+func (service *Service) unitName() string {
+	if service.Conf.UnitName != "" {
+		return service.Conf.UnitName
+	}
+	return service.Name
+}
+
+const systemdServiceTemplate = `%[2]s
+[Unit]
+Description=%[1]s
+{{- if .RunAfterService}}
+After={{.RunAfterService}}
+{{- end}}
+{{- if .StartLimitBurst}}
+StartLimitBurst={{.StartLimitBurst}}
+{{- end}}
+{{- if .StartLimitIntervalSec}}
+StartLimitIntervalSec={{.StartLimitIntervalSec}}
+{{- end}}
+{{- range $name, $value := .Conditions}}
+Condition{{conditionName $name}}={{$value}}
+{{- end}}
+{{- if .UnitExtra}}
+{{trim .UnitExtra}}
+{{- end}}
+
+[Service]
+Type={{.ServiceType}}
+Restart=always
+{{- if .RestartSec}}
+RestartSec={{.RestartSec}}
+{{- end}}
+{{- if .RestartSteps}}
+RestartSteps={{.RestartSteps}}
+{{- end}}
+{{- if .RestartMaxDelaySec}}
+RestartMaxDelaySec={{.RestartMaxDelaySec}}
+{{- end}}
+{{- if .Environment}}
+Environment={{systemdEnvironment .Environment}}
+{{- end}}
+{{- if .LogPath}}
+StandardOutput=append:{{.LogPath}}
+{{- end}}
+{{- if .LogPath}}
+StandardError=append:{{.LogPath}}
+{{- end}}
+WorkingDirectory={{.WorkingDirectory}}
+ExecStart={{.ExecStart}}
+{{- if .ExecCondition}}
+ExecCondition={{parseCommand .ExecCondition}}
+{{- end}}
+{{- if .ServiceExtra}}
+{{trim .ServiceExtra}}
+{{- end}}
+
+[Install]
+WantedBy=default.target
+{{- if .InstallExtra}}
+{{trim .InstallExtra}}
+{{- end}}`
+
+const openrcServiceTemplate = `#!/sbin/openrc-run
+%[2]s
+
+description="%[1]s"
+supervisor="supervise-daemon"
+command="{{execPath .ExecStart}}"
+command_args="{{execArgs .ExecStart}}"
+command_user="{{.User}}"
+directory="{{.WorkingDirectory}}"
+{{- if .RestartSec}}
+respawn_delay={{.RestartSec}}
+{{- end}}
+{{- if .Environment}}
+export {{shellEnvironment .Environment}}
+{{- end}}
+{{- if .LogPath}}
+output_log="{{.LogPath}}"
+error_log="{{.LogPath}}"
+{{- end}}
+{{- if .RunAfterService}}
+
+depend() {
+	after {{.RunAfterService}}
+}
+{{- end}}`
+
+const runitServiceTemplate = `#!/bin/sh
+%[2]s
+cd {{.WorkingDirectory}} || exit 1
+{{- if .Environment}}
+export {{shellEnvironment .Environment}}
+{{- end}}
+{{- if .LogPath}}
+exec >>{{.LogPath}} 2>&1
+{{- else}}
+exec 2>&1
+{{- end}}
+exec chpst -u {{.User}} {{.ExecStart}}`
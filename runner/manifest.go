@@ -0,0 +1,141 @@
+package runner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestEntry describes a service as it was after its last successful
+// install.
+type ManifestEntry struct {
+	// Hash of the resolved configuration and of the content of the copied
+	// files
+	ConfHash string `yaml:"conf_hash"`
+	// Checksum of the executable installed on the remote host. Empty in
+	// go-run mode: there is no built executable, the service runs the source
+	// copied with copy_files, whose content is part of ConfHash
+	ExecutableChecksum string `yaml:"executable_checksum"`
+}
+
+// Manifest records the services installed successfully, so that the services
+// not changed since can be skipped. It is safe for concurrent use.
+type Manifest struct {
+	mu      sync.Mutex
+	entries map[string]ManifestEntry
+}
+
+// LoadManifest reads the manifest file at path. If the file does not exist,
+// the manifest is empty.
+func LoadManifest(path string) (*Manifest, error) {
+	manifest := &Manifest{entries: make(map[string]ManifestEntry)}
+	buf, err := ioutil.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(buf, manifest.entries)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Save writes the manifest file at path.
+func (m *Manifest) Save(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	buf, err := yaml.Marshal(m.entries)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf, 0644)
+}
+
+// Unchanged reports whether the service s is unchanged since its last recorded
+// install: same configuration and copied files, same executable on the remote
+// host, except in go-run mode, installed service file up to date and service
+// enabled, if enabled on install.
+func (m *Manifest) Unchanged(s *Service) bool {
+	m.mu.Lock()
+	entry, found := m.entries[s.Name]
+	m.mu.Unlock()
+	if !found {
+		return false
+	}
+	hash, err := s.confHash()
+	if err != nil || hash != entry.ConfHash {
+		return false
+	}
+	if s.installedExecutable() != "" {
+		if checksum := s.executableChecksum(); checksum == "" || checksum != entry.ExecutableChecksum {
+			return false
+		}
+	}
+	if changed, err := s.UnitServiceFileChanged(); err != nil || changed {
+		return false
+	}
+	if !s.enableOnInstall() {
+		return true
+	}
+	enabled, _, err := s.IsEnabled()
+	return err == nil && enabled
+}
+
+// Record records the current state of the service s, after a successful
+// install.
+func (m *Manifest) Record(s *Service) error {
+	hash, err := s.confHash()
+	if err != nil {
+		return err
+	}
+	entry := ManifestEntry{ConfHash: hash, ExecutableChecksum: s.executableChecksum()}
+	m.mu.Lock()
+	m.entries[s.Name] = entry
+	m.mu.Unlock()
+	return nil
+}
+
+// confHash returns the hash of the resolved configuration of the service and
+// of the content of its local copy_files.
+func (s *Service) confHash() (string, error) {
+	conf, err := s.runner.ResolveConf(s.Name)
+	if err != nil {
+		return "", err
+	}
+	buf, err := yaml.Marshal(conf)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write(buf)
+	for _, copyFile := range conf.CopyFiles {
+		err := filepath.WalkDir(copyFile.Path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			io.WriteString(hash, path)
+			_, err = io.Copy(hash, file)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
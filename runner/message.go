@@ -2,6 +2,8 @@ package runner
 
 import (
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/charmbracelet/lipgloss"
 )
@@ -20,10 +22,58 @@ const (
 	MessageWarning // 1 << 3 which is 00001000
 )
 
+// MessageHandler is the type of the function called by the runner for each
+// message sent by a service. t is the time the message was sent.
+type MessageHandler func(serviceName, text string, status MessageStatus, t time.Time)
+
+// PrintMessageHandler returns a MessageHandler that prints the messages on w in
+// the same format used by StartPrintOutput.
+func PrintMessageHandler(w io.Writer) MessageHandler {
+	return func(serviceName, text string, status MessageStatus, t time.Time) {
+		m := message{serviceName: serviceName, text: text, status: status}
+		m.print(w, 0)
+	}
+}
+
+// Kinds of events. Messages and progress events carry a text, while step
+// events mark the start and the end of a step of a service command.
+type EventKind uint8
+
+const (
+	// Free text message
+	EventMessage EventKind = iota
+	// A step started
+	EventStepStart
+	// A step completed successfully
+	EventStepSuccess
+	// A step failed. The text is the error.
+	EventStepError
+	// Progress of a long operation, ex: an upload
+	EventProgress
+)
+
+// Event is a message sent by a service with the step it belongs to.
+type Event struct {
+	ServiceName string
+	Text        string
+	Status      MessageStatus
+	Kind        EventKind
+	// Name of the step in progress, ex: InstallExecutable, or an empty string
+	// if the message is not sent by a step
+	Step string
+	Time time.Time
+}
+
+// EventHandler is the type of the function called by the runner for each
+// event.
+type EventHandler func(event Event)
+
 type message struct {
 	serviceName string
 	text        string
 	status      MessageStatus
+	step        string
+	kind        EventKind
 }
 
 const (
@@ -58,7 +108,7 @@ var styles = map[MessageStatus]map[string]lipgloss.Style{
 	},
 }
 
-func (m *message) print(width int) {
+func (m *message) print(w io.Writer, width int) {
 
 	if styles[m.status] == nil {
 		return
@@ -72,10 +122,24 @@ func (m *message) print(width int) {
 	if m.text == "" && m.status == MessageSuccess {
 		m.text = "ok"
 	}
-	fmt.Println(lipgloss.JoinHorizontal(
+	serviceName := styles[m.status]["bold"].PaddingLeft(1).Width(width).Render("[" + m.serviceName + "]")
+	text := styles[m.status]["normal"].PaddingLeft(1)
+	// On a terminal the text fills the columns left, otherwise it is not
+	// wrapped
+	if columns := terminalWidth(w); columns > 0 {
+		textWidth := columns - lipgloss.Width(styles[m.status]["symbol"].String()) - lipgloss.Width(serviceName)
+		if textWidth < minTextWidth {
+			textWidth = minTextWidth
+		}
+		text = text.Width(textWidth)
+	}
+	fmt.Fprintln(w, lipgloss.JoinHorizontal(
 		lipgloss.Top,
 		styles[m.status]["symbol"].String(),
-		styles[m.status]["bold"].PaddingLeft(1).Width(width).Render("["+m.serviceName+"]"),
-		styles[m.status]["normal"].PaddingLeft(1).Width(120).Render(m.text),
+		serviceName,
+		text.Render(m.text),
 	))
 }
+
+// Minimum width of the message text column on narrow terminals.
+const minTextWidth = 20
@@ -0,0 +1,78 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+)
+
+// setNetrcMachine returns the content of the netrc file content with the entry
+// of machine set to login and password. An existing entry for machine is
+// replaced, otherwise the new entry is appended. Other entries, comments and
+// macro definitions are preserved.
+func setNetrcMachine(content, machine, login, password string) string {
+	entry := fmt.Sprintf("machine %s login %s password %s\n", machine, login, password)
+	start, end := findNetrcMachine(content, machine)
+	if start < 0 {
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		return content + entry
+	}
+	return content[:start] + entry + content[end:]
+}
+
+// findNetrcMachine returns the byte offsets of the entry of machine in the
+// netrc file content, or -1 if not found. The entry runs from its `machine`
+// token to the start of the next entry.
+func findNetrcMachine(content, machine string) (int, int) {
+	start := -1
+	next := func(i int) (string, int, int) {
+		for i < len(content) && strings.ContainsRune(" \t\r\n", rune(content[i])) {
+			i++
+		}
+		j := i
+		for j < len(content) && !strings.ContainsRune(" \t\r\n", rune(content[j])) {
+			j++
+		}
+		return content[i:j], i, j
+	}
+	for i := 0; i < len(content); {
+		token, tokenStart, tokenEnd := next(i)
+		if token == "" {
+			break
+		}
+		i = tokenEnd
+		switch token {
+		case "machine", "default":
+			if start >= 0 {
+				return start, tokenStart
+			}
+			if token == "machine" {
+				name, _, nameEnd := next(i)
+				if name == machine {
+					start = tokenStart
+				}
+				i = nameEnd
+			}
+		case "macdef":
+			// The macro body runs up to the first empty line
+			if end := strings.Index(content[i:], "\n\n"); end >= 0 {
+				i += end + 2
+			} else {
+				i = len(content)
+			}
+		default:
+			if strings.HasPrefix(token, "#") {
+				if end := strings.IndexByte(content[i:], '\n'); end >= 0 {
+					i += end + 1
+				} else {
+					i = len(content)
+				}
+			}
+		}
+	}
+	if start >= 0 {
+		return start, len(content)
+	}
+	return -1, -1
+}
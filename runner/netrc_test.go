@@ -0,0 +1,100 @@
+package runner
+
+import "testing"
+
+func TestSetNetrcMachine(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "empty",
+			content: "",
+			want:    "machine github.com login god password secret\n",
+		},
+		{
+			name:    "append without final newline",
+			content: "machine a.com login a password pa",
+			want:    "machine a.com login a password pa\nmachine github.com login god password secret\n",
+		},
+		{
+			name: "append keeping other machines",
+			content: `machine a.com
+  login a
+  password pa
+
+machine github.com.example.com login b password pb
+`,
+			want: `machine a.com
+  login a
+  password pa
+
+machine github.com.example.com login b password pb
+machine github.com login god password secret
+`,
+		},
+		{
+			name: "update between other machines",
+			content: `machine a.com
+  login a
+  password pa
+
+machine github.com
+  login old
+  password oldpass
+
+machine b.com login b password pb
+`,
+			want: `machine a.com
+  login a
+  password pa
+
+machine github.com login god password secret
+machine b.com login b password pb
+`,
+		},
+		{
+			name: "update last machine",
+			content: `machine a.com login a password pa
+machine github.com login old password oldpass
+`,
+			want: `machine a.com login a password pa
+machine github.com login god password secret
+`,
+		},
+		{
+			name: "update before default",
+			content: `machine github.com login old password oldpass
+default login anonymous password guest
+`,
+			want: `machine github.com login god password secret
+default login anonymous password guest
+`,
+		},
+		{
+			name: "comments and macros",
+			content: `# machine github.com login commented password out
+machine a.com login a password pa
+macdef init
+echo machine github.com
+
+machine github.com login old password oldpass
+`,
+			want: `# machine github.com login commented password out
+machine a.com login a password pa
+macdef init
+echo machine github.com
+
+machine github.com login god password secret
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := setNetrcMachine(test.content, "github.com", "god", "secret"); got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
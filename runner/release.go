@@ -0,0 +1,96 @@
+package runner
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Release is a copy of the service executable kept on the remote host by
+// install, named after the install time.
+type Release timestampedFile
+
+// releaseDirectory returns the remote directory where install keeps the
+// releases of the service.
+func (s *Service) releaseDirectory() string {
+	return filepath.Join(s.remoteHomeDir, ".god", "releases", s.Name)
+}
+
+// KeepRelease copies the installed executable in the releases directory of the
+// service, and deletes the releases except the keep_releases most recent ones.
+// Does nothing if keep_releases is not set or in go-run mode.
+func (s *Service) KeepRelease() error {
+	executable := s.installedExecutable()
+	if s.Conf.KeepReleases <= 0 || executable == "" {
+		return nil
+	}
+	dir := s.releaseDirectory()
+	release := filepath.Join(dir, time.Now().UTC().Format(backupTimeLayout))
+	cmd := fmt.Sprintf("mkdir -p %s && cp -p %s %s", shellQuote(dir), shellQuote(executable), shellQuote(release))
+	s.runner.SendMessage(s.Name, cmd, MessageNormal)
+	output, err := s.Exec(cmd)
+	if err != nil {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("cannot keep release: %s", output), MessageError)
+		return err
+	}
+	s.runner.SendMessage(s.Name, fmt.Sprintf("Release kept in '%s'", release), MessageSuccess)
+	return s.PruneReleases(s.Conf.KeepReleases)
+}
+
+// Releases returns the releases of the service on the remote host, the most
+// recent first.
+func (s *Service) Releases() ([]Release, error) {
+	files, err := s.timestampedFiles(s.releaseDirectory(), "", "")
+	if err != nil {
+		return nil, err
+	}
+	releases := make([]Release, len(files))
+	for i, file := range files {
+		releases[i] = Release(file)
+	}
+	return releases, nil
+}
+
+// ListReleases prints the releases of the service, the most recent first, with
+// their time and size.
+func (s *Service) ListReleases() error {
+	releases, err := s.Releases()
+	if err != nil {
+		s.runner.SendMessage(s.Name, err.Error(), MessageError)
+		return err
+	}
+	if len(releases) == 0 {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("No releases in '%s'", s.releaseDirectory()), MessageSuccess)
+		return nil
+	}
+	lines := make([]string, len(releases))
+	for i, release := range releases {
+		lines[i] = fmt.Sprintf("%s  %8.1f MiB  %s", release.Time.Local().Format("2006-01-02 15:04:05"), float64(release.Size)/(1<<20), release.Path)
+	}
+	s.runner.SendMessage(s.Name, strings.Join(lines, "\n"), MessageSuccess)
+	return nil
+}
+
+// PruneReleases deletes the releases of the service on the remote host except
+// the keep most recent ones.
+func (s *Service) PruneReleases(keep int) error {
+	releases, err := s.Releases()
+	if err != nil {
+		s.runner.SendMessage(s.Name, err.Error(), MessageError)
+		return err
+	}
+	if len(releases) <= keep {
+		s.runner.SendMessage(s.Name, fmt.Sprintf("Nothing to prune: %d releases", len(releases)), MessageSuccess)
+		return nil
+	}
+	for _, release := range releases[keep:] {
+		if err := s.client.SftClient.Remove(release.Path); err != nil {
+			s.runner.SendMessage(s.Name, fmt.Sprintf("cannot delete release '%s': %s", release.Path, err), MessageError)
+			return err
+		}
+		s.runner.SendMessage(s.Name, fmt.Sprintf("Deleted '%s'", release.Path), MessageNormal)
+	}
+	s.runner.SendMessage(s.Name, fmt.Sprintf("Kept the %d most recent releases", keep), MessageSuccess)
+	return nil
+}
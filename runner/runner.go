@@ -3,75 +3,290 @@
 package runner
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/pioz/god/sshcmd"
 	"gopkg.in/yaml.v3"
 )
 
 // Conf holds a service configuration.
 type Conf struct {
-	User           string `yaml:"user"`
-	Host           string `yaml:"host"`
-	Port           string `yaml:"port"`
-	PrivateKeyPath string `yaml:"private_key_path"`
+	User                 string   `yaml:"user"`
+	Host                 string   `yaml:"host"`
+	Port                 string   `yaml:"port"`
+	PrivateKeyPath       string   `yaml:"private_key_path"`
+	PrivateKeyPaths      []string `yaml:"private_key_paths"`
+	PrivateKeyPassphrase string   `yaml:"private_key_passphrase"`
+	HostKey              string   `yaml:"host_key"`
+	Proxy                string   `yaml:"proxy"`
+	ForwardAgent         bool     `yaml:"forward_agent"`
+	RemoteShell          string   `yaml:"remote_shell"`
+	ResolveTimeoutSec    int      `yaml:"resolve_timeout_sec"`
+	KeyExchanges         []string `yaml:"key_exchanges"`
+	Ciphers              []string `yaml:"ciphers"`
+	MACs                 []string `yaml:"macs"`
+	HostKeyAlgorithms    []string `yaml:"host_key_algorithms"`
 
-	GoExecPath     string `yaml:"go_exec_path"`
-	GoBinDirectory string `yaml:"go_bin_directory"`
-	GoInstall      string `yaml:"go_install"`
+	GoExecPath     string   `yaml:"go_exec_path"`
+	GoBinDirectory string   `yaml:"go_bin_directory"`
+	GoInstall      string   `yaml:"go_install"`
+	RunMode        string   `yaml:"run_mode"`
+	GitRepo        string   `yaml:"git_repo"`
+	GitRef         string   `yaml:"git_ref"`
+	BuildDirectory string   `yaml:"build_directory"`
+	BuildCommand   string   `yaml:"build_command"`
+	ExtraInstalls  []string `yaml:"extra_installs"`
+	InstallRetries int      `yaml:"install_retries"`
+	KeepReleases   int      `yaml:"keep_releases"`
+	MinFreeDiskMB  int      `yaml:"min_free_disk_mb"`
+	ForwardEnv     []string `yaml:"forward_env"`
+	UseMise        string   `yaml:"use_mise"`
+
+	PreBuild          string `yaml:"pre_build"`
+	PreBuildDirectory string `yaml:"pre_build_directory"`
 
 	GoPrivate     string `yaml:"go_private"`
 	NetrcMachine  string `yaml:"netrc_machine"`
 	NetrcLogin    string `yaml:"netrc_login"`
 	NetrcPassword string `yaml:"netrc_password"`
 
+	InitSystem               string `yaml:"init_system"`
 	SystemdPath              string `yaml:"systemd_path"`
 	SystemdServicesDirectory string `yaml:"systemd_services_directory"`
 	SystemdLingerDirectory   string `yaml:"systemd_linger_directory"`
+	SkipLingerCheck          bool   `yaml:"skip_linger_check"`
+	UnitName                 string `yaml:"unit_name"`
+
+	ServiceType             string `yaml:"service_type"`
+	ReadyTimeoutSec         int    `yaml:"ready_timeout_sec"`
+	ExecStart               string `yaml:"exec_start"`
+	ExecCondition           string `yaml:"exec_condition"`
+	WorkingDirectory        string `yaml:"working_directory"`
+	CreateWorkingDirectory  *bool  `yaml:"create_working_directory"`
+	WorkingDirectoryMode    string `yaml:"working_directory_mode"`
+	EnableOnInstall         *bool  `yaml:"enable_on_install"`
+	Environment             string `yaml:"environment"`
+	LogPath                 string `yaml:"log_path"`
+	PreserveLogsOnUninstall bool   `yaml:"preserve_logs_on_uninstall"`
+	RunAfterService         string `yaml:"run_after_service"`
+	StartLimitBurst         int    `yaml:"start_limit_burst"`
+	StartLimitIntervalSec   int    `yaml:"start_limit_interval_sec"`
+	RestartSec              int    `yaml:"restart_sec"`
+	RestartSteps            int    `yaml:"restart_steps"`
+	RestartMaxDelaySec      int    `yaml:"restart_max_delay_sec"`
+
+	PostInstall         string `yaml:"post_install"`
+	PostInstallRequired bool   `yaml:"post_install_required"`
+
+	Conditions map[string]string `yaml:"conditions"`
+
+	UnitExtra    string `yaml:"unit_extra"`
+	ServiceExtra string `yaml:"service_extra"`
+	InstallExtra string `yaml:"install_extra"`
+
+	CopyFiles       []CopyFile `yaml:"copy_files"`
+	CompressUploads bool       `yaml:"compress_uploads"`
+	Watch           []string   `yaml:"watch"`
+
+	Quiet     bool     `yaml:"quiet"`
+	Verbose   bool     `yaml:"verbose"`
+	Ignore    bool     `yaml:"ignore"`
+	SkipIf    string   `yaml:"skip_if"`
+	OnlyIf    string   `yaml:"only_if"`
+	Protected bool     `yaml:"protected"`
+	Tags      []string `yaml:"tags"`
+}
+
+// CopyFile is a local file copied to the remote working directory. In the YAML
+// configuration file it can be the path alone, or a map with the path and the
+// remote owner and group of the file.
+type CopyFile struct {
+	Path  string `yaml:"path" json:"path"`
+	Owner string `yaml:"owner,omitempty" json:"owner,omitempty"`
+	Group string `yaml:"group,omitempty" json:"group,omitempty"`
+}
+
+func (f *CopyFile) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&f.Path)
+	}
+	type plain CopyFile
+	return value.Decode((*plain)(f))
+}
+
+func (f CopyFile) MarshalYAML() (interface{}, error) {
+	if f.Owner == "" && f.Group == "" {
+		return f.Path, nil
+	}
+	type plain CopyFile
+	return plain(f), nil
+}
+
+// Copy returns a deep copy of the configuration.
+func (c *Conf) Copy() *Conf {
+	conf := *c
+	conf.PrivateKeyPaths = append([]string(nil), c.PrivateKeyPaths...)
+	conf.KeyExchanges = append([]string(nil), c.KeyExchanges...)
+	conf.Ciphers = append([]string(nil), c.Ciphers...)
+	conf.MACs = append([]string(nil), c.MACs...)
+	conf.HostKeyAlgorithms = append([]string(nil), c.HostKeyAlgorithms...)
+	conf.ExtraInstalls = append([]string(nil), c.ExtraInstalls...)
+	conf.ForwardEnv = append([]string(nil), c.ForwardEnv...)
+	conf.CopyFiles = append([]CopyFile(nil), c.CopyFiles...)
+	conf.Watch = append([]string(nil), c.Watch...)
+	conf.Tags = append([]string(nil), c.Tags...)
+	if c.Conditions != nil {
+		conf.Conditions = make(map[string]string, len(c.Conditions))
+		for name, value := range c.Conditions {
+			conf.Conditions[name] = value
+		}
+	}
+	if c.CreateWorkingDirectory != nil {
+		createWorkingDirectory := *c.CreateWorkingDirectory
+		conf.CreateWorkingDirectory = &createWorkingDirectory
+	}
+	if c.EnableOnInstall != nil {
+		enableOnInstall := *c.EnableOnInstall
+		conf.EnableOnInstall = &enableOnInstall
+	}
+	return &conf
+}
 
-	ExecStart             string `yaml:"exec_start"`
-	WorkingDirectory      string `yaml:"working_directory"`
-	Environment           string `yaml:"environment"`
-	LogPath               string `yaml:"log_path"`
-	RunAfterService       string `yaml:"run_after_service"`
-	StartLimitBurst       int    `yaml:"start_limit_burst"`
-	StartLimitIntervalSec int    `yaml:"start_limit_interval_sec"`
-	RestartSec            int    `yaml:"restart_sec"`
+// Placeholder of the secret configuration values in Redacted.
+const redactedValue = "<redacted>"
 
-	CopyFiles []string `yaml:"copy_files"`
+// Redacted returns a copy of the configuration with the secret values, like
+// netrc_password and private_key_passphrase, replaced with `<redacted>`, to
+// be printed.
+func (c *Conf) Redacted() *Conf {
+	conf := c.Copy()
+	for _, value := range []*string{&conf.NetrcPassword, &conf.PrivateKeyPassphrase} {
+		if *value != "" {
+			*value = redactedValue
+		}
+	}
+	return conf
+}
 
-	Ignore bool `yaml:"ignore"`
+// Map returns the configuration as a map keyed by YAML option names.
+func (c *Conf) Map() map[string]interface{} {
+	m := make(map[string]interface{})
+	reflectValue := reflect.ValueOf(c).Elem()
+	for i := 0; i < reflectValue.NumField(); i++ {
+		yamlTagValue := reflectValue.Type().Field(i).Tag.Get("yaml")
+		if yamlTagValue != "" {
+			m[yamlTagValue] = reflectValue.Field(i).Interface()
+		}
+	}
+	return m
 }
 
 type Runner struct {
-	QuietMode    bool
-	confFilePath string
-	conf         map[string]*Conf
-	services     map[string]Service
-	mu           sync.Mutex
-	output       chan message
-	quit         chan struct{}
+	QuietMode   bool
+	StrictDrift bool
+	// Fail install if a run_after_service unit does not exist on the remote
+	// host, instead of printing a warning
+	StrictDeps bool
+	FailFast   bool
+	// Authenticate only with the local SSH agent, never reading the private
+	// key files
+	AgentOnly bool
+	// Passphrase of the private keys of the services without
+	// private_key_passphrase
+	KeyPassphrase string
+	// Skip the lingering check of all services
+	AssumeLinger bool
+	// Do not delete the log files of the services on uninstall
+	KeepLogs bool
+	// Do not enable the services on install, unless enable_on_install is set
+	NoEnable bool
+	// Number of concurrent sftp write requests used to upload each copied
+	// file. Zero or one writes a single request at a time.
+	SftpConcurrency int
+	// Run only the read-only steps of install and uninstall: the steps that
+	// change the local or the remote host are reported as simulated
+	DryRun bool
+	// Fail the services that sent a warning message, once their command is
+	// completed
+	WarningsAsErrors bool
+	// Print the duration of each install and uninstall step
+	Verbose bool
+	// Steps longer than SlowStepThreshold are reported with a warning. Zero
+	// disables the warning.
+	SlowStepThreshold time.Duration
+	confFilePath      string
+	conf              map[string]*Conf
+	services          map[string]Service
+	clients           map[string]*sharedClient
+	mu                sync.Mutex
+	output            chan message
+	quit              chan struct{}
+	ctx               context.Context
+	out               io.Writer
+	handler           MessageHandler
+	eventHandler      EventHandler
+	steps             map[string]string
+	handlerMu         sync.Mutex
+	running           map[string]bool
+	slowestSteps      map[string]StepTiming
+	warnings          map[string]int
+}
+
+// StepTiming is the duration of a step of a service command.
+type StepTiming struct {
+	Name     string
+	Duration time.Duration
 }
 
 // MakeRunner loads the configuration from confFilePath and returns an
 // initialized Runner.
 func MakeRunner(confFilePath string) (*Runner, error) {
+	return MakeRunnerForEnvironment(confFilePath, "")
+}
+
+// MakeRunnerForEnvironment is like MakeRunner, but the options under the
+// environment key of the environments block of each service override the
+// service options. If environment is empty, the environments are ignored.
+func MakeRunnerForEnvironment(confFilePath, environment string) (*Runner, error) {
+	return MakeRunnerForFormat(confFilePath, "", environment)
+}
+
+// MakeRunnerForFormat is like MakeRunnerForEnvironment, but the configuration
+// is read in format: yaml, json or toml. If format is empty, it is picked from
+// the extension of confFilePath. If confFilePath is `-`, the configuration is
+// read from the standard input, as YAML by default.
+func MakeRunnerForFormat(confFilePath, format, environment string) (*Runner, error) {
 	runner := &Runner{
 		confFilePath: confFilePath,
 		services:     make(map[string]Service),
+		clients:      make(map[string]*sharedClient),
+		running:      make(map[string]bool),
+		steps:        make(map[string]string),
+		slowestSteps: make(map[string]StepTiming),
+		warnings:     make(map[string]int),
 		output:       make(chan message),
 		quit:         make(chan struct{}),
+		ctx:          context.Background(),
+		out:          os.Stdout,
 	}
-	conf, err := readConf(confFilePath)
+	conf, err := readConf(confFilePath, format, environment)
 	if err != nil {
 		return nil, err
 	}
@@ -79,6 +294,35 @@ func MakeRunner(confFilePath string) (*Runner, error) {
 	return runner, nil
 }
 
+// SetContext sets the context used by all services of the runner. When ctx is
+// done, no more remote commands are run: the commands in progress are allowed
+// to complete and the following ones fail with the context error.
+func (r *Runner) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// SetOutput sets the writer where StartPrintOutput prints the messages. The
+// default is os.Stdout.
+func (r *Runner) SetOutput(w io.Writer) {
+	r.out = w
+}
+
+// SetMessageHandler routes all messages to handler instead of the channel read
+// by StartPrintOutput, so the runner can be used without the printing go
+// routine: with a handler set, StartPrintOutput and StopPrintOutput do nothing.
+// Calls to handler are serialized.
+func (r *Runner) SetMessageHandler(handler MessageHandler) {
+	r.handler = handler
+}
+
+// SetEventHandler routes all messages to handler as events, including the
+// start and the end of each step, instead of the channel read by
+// StartPrintOutput. It takes precedence over SetMessageHandler. Calls to
+// handler are serialized.
+func (r *Runner) SetEventHandler(handler EventHandler) {
+	r.eventHandler = handler
+}
+
 // GetServiceNames returns a slice with all not ignored services found in the
 // configuration file.
 func (r *Runner) GetServiceNames() []string {
@@ -91,26 +335,29 @@ func (r *Runner) GetServiceNames() []string {
 	return names
 }
 
-// MakeService makes a new Service using the configuration under serviceName key
-// in the configuration file.
-func (r *Runner) MakeService(serviceName string) (Service, error) {
-	// Fetch service from cache
-	s, found := r.services[serviceName]
-	if found {
-		return s, nil
-	}
+// GetConf returns the configuration under serviceName key in the configuration
+// file, or nil if not found. Defaults are not applied.
+func (r *Runner) GetConf(serviceName string) *Conf {
+	return r.conf[serviceName]
+}
 
-	// Fetch service configuration
-	conf, found := r.conf[serviceName]
+// ResolveConf returns a copy of the configuration under serviceName key in the
+// configuration file, validated and with the defaults that do not depend on
+// the remote host set. The defaults detected on the remote host are set by
+// MakeService.
+func (r *Runner) ResolveConf(serviceName string) (*Conf, error) {
+	// Defaults are set on a copy, so the loaded configuration is never mutated
+	loadedConf, found := r.conf[serviceName]
 	if !found {
 		err := fmt.Errorf("configuration for service `%s` was not found. Please add service configuration in `%s` file", serviceName, r.confFilePath)
-		return Service{}, err
+		return nil, &kindError{kind: ErrServiceNotFound, err: err}
 	}
+	conf := loadedConf.Copy()
 
 	// Validate configuration
 	err := r.validateConf(conf)
 	if err != nil {
-		return Service{}, err
+		return nil, err
 	}
 
 	// Set SSH connection default configuration for missing values
@@ -123,98 +370,455 @@ func (r *Runner) MakeService(serviceName string) (Service, error) {
 	if conf.Port == "" {
 		conf.Port = "22"
 	}
-	if conf.PrivateKeyPath == "" {
+	if conf.PrivateKeyPath == "" && len(conf.PrivateKeyPaths) == 0 {
 		conf.PrivateKeyPath = filepath.Join(os.Getenv("HOME"), "/.ssh/id_rsa")
 	}
 
-	// Create SSH client
-	client, err := sshcmd.MakeClient(conf.User, conf.Host, conf.Port, conf.PrivateKeyPath)
+	// Systemd conf
+	if conf.ServiceType == "" {
+		conf.ServiceType = "simple"
+	}
+	if conf.ReadyTimeoutSec == 0 {
+		conf.ReadyTimeoutSec = 30
+	}
+	if conf.SystemdPath == "" {
+		conf.SystemdPath = "systemd"
+	}
+	if conf.SystemdServicesDirectory == "" {
+		conf.SystemdServicesDirectory = initSystems[conf.InitSystem].servicesDirectory
+	}
+	if conf.SystemdLingerDirectory == "" {
+		conf.SystemdLingerDirectory = "/var/lib/systemd/linger"
+	}
+
+	return conf, nil
+}
+
+// SkipReason evaluates the skip_if and only_if conditions of the service
+// serviceName and returns why the service must be skipped, or an empty string
+// if it must run.
+func (r *Runner) SkipReason(serviceName string) (string, error) {
+	conf, found := r.conf[serviceName]
+	if !found {
+		return "", nil
+	}
+	if conf.SkipIf != "" {
+		skip, err := evalCondition(conf.SkipIf)
+		if err != nil {
+			return "", configError("invalid configuration `skip_if` of service `%s`: %s", serviceName, err)
+		}
+		if skip {
+			return fmt.Sprintf("skip_if `%s` is true", conf.SkipIf), nil
+		}
+	}
+	if conf.OnlyIf != "" {
+		run, err := evalCondition(conf.OnlyIf)
+		if err != nil {
+			return "", configError("invalid configuration `only_if` of service `%s`: %s", serviceName, err)
+		}
+		if !run {
+			return fmt.Sprintf("only_if `%s` is false", conf.OnlyIf), nil
+		}
+	}
+	return "", nil
+}
+
+// RenderServiceFile writes in w the service file of the service serviceName
+// without connecting to the remote host. The defaults computed on the remote
+// host are replaced with placeholder. Returns the service file name, relative
+// to the services directory.
+func (r *Runner) RenderServiceFile(serviceName, placeholder string, w io.Writer) (string, error) {
+	conf, err := r.ResolveConf(serviceName)
+	if err != nil {
+		return "", err
+	}
+	for _, value := range []*string{&conf.GoBinDirectory, &conf.GoExecPath, &conf.WorkingDirectory} {
+		if *value == "" {
+			*value = placeholder
+		}
+	}
+	if conf.ExecStart == "" {
+		conf.ExecStart = defaultExecStart(conf)
+	}
+	conf.ExecStart = absoluteExecStart(conf)
+	conf.LogPath, err = resolveLogPath(conf, serviceName, placeholder)
+	if err != nil {
+		return "", configError("invalid configuration `log_path` of service `%s`: %s in `%s` file", serviceName, err, r.confFilePath)
+	}
+	service := Service{Name: serviceName, Conf: conf, runner: r}
+	if err := service.GenerateServiceFile(w); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(service.initSystem().serviceFileName, service.unitName()), nil
+}
+
+// MakeService makes a new Service using the configuration under serviceName key
+// in the configuration file.
+func (r *Runner) MakeService(serviceName string) (Service, error) {
+	return r.makeService(r.ctx, serviceName)
+}
+
+// makeService is like MakeService, but the service runs its remote commands
+// with ctx instead of the runner context.
+func (r *Runner) makeService(ctx context.Context, serviceName string) (Service, error) {
+	// Fetch service from cache, unless its connection was closed since
+	r.mu.Lock()
+	s, found := r.services[serviceName]
+	r.mu.Unlock()
+	if found && !s.client.Closed() {
+		s.ctx = ctx
+		return s, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return Service{}, err
+	}
+
+	conf, err := r.ResolveConf(serviceName)
 	if err != nil {
 		return Service{}, err
 	}
 
-	// Connect the client
-	err = client.Connect()
+	// Create SSH client, shared with the services with the same endpoint
+	client, err := r.connect(serviceName, conf)
 	if err != nil {
 		return Service{}, err
 	}
 
 	// Create the service
-	service := Service{Name: serviceName, Conf: conf, client: client, runner: r}
+	service := Service{Name: serviceName, Conf: conf, client: client, runner: r, ctx: ctx}
 
-	// Find remote host working directory
-	pwd, err := service.Exec("pwd")
+	// Find remote host home directory. The directory where the SSH session
+	// lands is not guaranteed to be $HOME, so use it only as fallback.
+	home, err := service.Exec("echo $HOME")
 	if err != nil {
 		return Service{}, err
 	}
-	service.remoteHomeDir = pwd
+	if home == "" {
+		home, err = service.Exec("pwd")
+		if err != nil {
+			return Service{}, err
+		}
+	}
+	service.remoteHomeDir = home
 
 	// Set default configuration for missing values
 
 	// Go conf
+	// Like go install, fall back on the bin directory of the first GOPATH entry
+	// if GOBIN is not set, and on the default GOPATH if go env fails
 	if conf.GoBinDirectory == "" {
-		conf.GoBinDirectory, err = service.Exec("go env GOBIN")
-		if err != nil {
-			conf.GoBinDirectory = ""
-		}
+		conf.GoBinDirectory = service.execWithMise("go env GOBIN")
 	}
 	if conf.GoBinDirectory == "" {
-		conf.GoBinDirectory, err = service.Exec("mise exec -- go env GOBIN")
-		if err != nil {
-			conf.GoBinDirectory = ""
+		if gopath := service.execWithMise("go env GOPATH"); gopath != "" {
+			conf.GoBinDirectory = filepath.Join(strings.Split(gopath, ":")[0], "bin")
 		}
 	}
-	if conf.GoBinDirectory == "" {
-		return Service{}, fmt.Errorf("$GOBIN environment variable is not set on the remote host: please set the $GOBIN env variable on the remote host or add `go_bin_directory: <path>` in `%s` file", r.confFilePath)
+	if conf.GoBinDirectory == "" && home != "" {
+		conf.GoBinDirectory = filepath.Join(home, "go", "bin")
 	}
-	if conf.GoExecPath == "" {
-		conf.GoExecPath, err = service.Exec("which go")
-		if err != nil {
-			conf.GoExecPath = ""
-		}
+	if conf.GoBinDirectory == "" {
+		return Service{}, fmt.Errorf("cannot find where `go install` puts executables on the remote host: please set the $GOBIN env variable on the remote host or add `go_bin_directory: <path>` in `%s` file", r.confFilePath)
 	}
 	if conf.GoExecPath == "" {
-		conf.GoExecPath, err = service.Exec("mise exec -- which go")
-		if err != nil {
-			conf.GoExecPath = ""
-		}
+		conf.GoExecPath = service.execWithMise("which go")
 	}
 	if conf.GoExecPath == "" {
 		conf.GoExecPath = filepath.Join(conf.GoBinDirectory, "go")
 	}
 
 	// Systemd conf
-	if conf.SystemdPath == "" {
-		conf.SystemdPath = "systemd"
-	}
 	if conf.SystemdServicesDirectory == "" {
-		conf.SystemdServicesDirectory = filepath.Join(pwd, ".config/systemd/user")
-	}
-	if conf.SystemdLingerDirectory == "" {
-		conf.SystemdLingerDirectory = "/var/lib/systemd/linger"
+		configHome, _ := service.Exec("echo $XDG_CONFIG_HOME")
+		if configHome == "" {
+			configHome = filepath.Join(home, ".config")
+		}
+		conf.SystemdServicesDirectory = filepath.Join(configHome, "systemd/user")
 	}
 
 	// Service conf
 	if conf.ExecStart == "" {
-		exec := getExec(conf.GoInstall)
-		if exec != "" {
-			conf.ExecStart = filepath.Join(conf.GoBinDirectory, exec)
-		}
+		conf.ExecStart = defaultExecStart(conf)
+	}
+	if conf.GitRepo != "" && conf.BuildDirectory == "" {
+		conf.BuildDirectory = filepath.Join(home, ".god", "src", serviceName)
 	}
+	// The working directory defaults to the home directory, which is also never
+	// removed on uninstall
 	if conf.WorkingDirectory == "" {
-		conf.WorkingDirectory = pwd
+		conf.WorkingDirectory = home
+	}
+	conf.ExecStart = absoluteExecStart(conf)
+	conf.LogPath, err = resolveLogPath(conf, serviceName, home)
+	if err != nil {
+		return Service{}, configError("invalid configuration `log_path` of service `%s`: %s in `%s` file", serviceName, err, r.confFilePath)
+	}
+	// systemd resolves the %h and %u specifiers in the service file, but the
+	// remote commands need the expanded paths
+	if service.initSystem().specifiers {
+		service.unitConf = conf.Copy()
+		conf.WorkingDirectory = service.expandSpecifiers(conf.WorkingDirectory)
+		conf.ExecStart = service.expandSpecifiers(conf.ExecStart)
+		conf.LogPath = service.expandSpecifiers(conf.LogPath)
 	}
-	// Save cache
+	// Save cache, without the context of this run
+	cached := service
+	cached.ctx = nil
 	r.mu.Lock()
-	r.services[serviceName] = service
+	r.services[serviceName] = cached
 	r.mu.Unlock()
 
 	return service, nil
 }
 
+// sharedClient is a SSH connection shared by the services with the same
+// endpoint.
+type sharedClient struct {
+	// Closed once the connection is dialed, successfully or not
+	dialed chan struct{}
+	client *sshcmd.Client
+	err    error
+}
+
+// broken reports whether the shared connection cannot be used anymore: its
+// dial failed or it was closed since. A connection still being dialed is not
+// broken.
+func (shared *sharedClient) broken() bool {
+	select {
+	case <-shared.dialed:
+		return shared.err != nil || shared.client.Closed()
+	default:
+		return false
+	}
+}
+
+// clientKey returns the key of the SSH connection used by a service with
+// configuration conf. Services share a connection only if they connect to the
+// same user, host and port, with the same private keys, proxy, host key,
+// algorithms and agent forwarding.
+func clientKey(conf *Conf) string {
+	port := conf.Port
+	if port == "" {
+		port = "22"
+	}
+	return strings.Join([]string{
+		conf.User, conf.Host, port, conf.PrivateKeyPath, conf.Proxy, conf.HostKey,
+		strings.Join(conf.PrivateKeyPaths, ","),
+		strings.Join(conf.KeyExchanges, ","),
+		strings.Join(conf.Ciphers, ","),
+		strings.Join(conf.MACs, ","),
+		strings.Join(conf.HostKeyAlgorithms, ","),
+		strconv.FormatBool(conf.ForwardAgent),
+		conf.RemoteShell,
+	}, "\x00")
+}
+
+// connect returns the connected SSH client of the endpoint in conf, connecting
+// it the first time it is requested by the service serviceName. A connection
+// whose dial failed or that was closed since is replaced by a new one, so that
+// a later run, ex: of the watch mode, connects again.
+func (r *Runner) connect(serviceName string, conf *Conf) (*sshcmd.Client, error) {
+	key := clientKey(conf)
+	r.mu.Lock()
+	shared, found := r.clients[key]
+	if !found || shared.broken() {
+		shared = &sharedClient{dialed: make(chan struct{})}
+		r.clients[key] = shared
+		r.mu.Unlock()
+		shared.client, shared.err = r.dial(serviceName, conf)
+		close(shared.dialed)
+		return shared.client, shared.err
+	}
+	r.mu.Unlock()
+	<-shared.dialed
+	return shared.client, shared.err
+}
+
+// dial makes a new SSH client with the connection options in conf and connects
+// it. The private keys of private_key_paths that cannot be read are skipped
+// with a warning sent for the service serviceName.
+func (r *Runner) dial(serviceName string, conf *Conf) (*sshcmd.Client, error) {
+	// In agent-only mode no private key file is ever read
+	privateKeyPath := conf.PrivateKeyPath
+	if r.AgentOnly {
+		privateKeyPath = ""
+	}
+	client, err := sshcmd.MakeClient(conf.User, conf.Host, conf.Port, privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	client.AgentOnly = r.AgentOnly
+	if len(conf.PrivateKeyPaths) > 0 && !r.AgentOnly {
+		loaded := conf.PrivateKeyPath != ""
+		for _, path := range conf.PrivateKeyPaths {
+			if err := client.AddPrivateKey(path); err != nil {
+				r.SendMessage(serviceName, fmt.Sprintf("private key skipped: %s", err), MessageWarning)
+				continue
+			}
+			loaded = true
+		}
+		if !loaded {
+			return nil, errors.New("none of the private keys in `private_key_paths` can be read")
+		}
+	}
+
+	client.HostKey = conf.HostKey
+	client.Proxy = conf.Proxy
+	client.ResolveTimeout = time.Duration(conf.ResolveTimeoutSec) * time.Second
+	client.KeyExchanges = conf.KeyExchanges
+	client.Ciphers = conf.Ciphers
+	client.MACs = conf.MACs
+	client.HostKeyAlgorithms = conf.HostKeyAlgorithms
+	client.ForwardAgent = conf.ForwardAgent
+	client.Shell = conf.RemoteShell
+	client.Passphrase = conf.PrivateKeyPassphrase
+	if client.Passphrase == "" {
+		client.Passphrase = r.KeyPassphrase
+	}
+
+	err = client.Connect()
+	if errors.Is(err, sshcmd.ErrPassphraseMissing) {
+		return nil, fmt.Errorf("%s: please add `private_key_passphrase: ${<VAR>}` in `%s` file", err, r.confFilePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Run makes the services serviceNames and calls fn on each of them
+// concurrently. It waits for all calls to finish and returns a ServicesError
+// with the errors of the failed services, or nil if all succeeded.
+//
+// If FailFast is true, the first error cancels the run of the other services:
+// they stop at the next safe point like when the runner context is done.
+func (r *Runner) Run(serviceNames []string, fn func(s *Service) error) error {
+	// The services of this run only are canceled on failure
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+
+	errs := make(ServicesError)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	wg.Add(len(serviceNames))
+	r.mu.Lock()
+	for _, serviceName := range serviceNames {
+		r.running[serviceName] = true
+		delete(r.warnings, serviceName)
+	}
+	r.mu.Unlock()
+	for _, serviceName := range serviceNames {
+		go func(serviceName string) {
+			defer wg.Done()
+			defer func() {
+				r.mu.Lock()
+				delete(r.running, serviceName)
+				r.mu.Unlock()
+			}()
+			s, err := r.makeService(ctx, serviceName)
+			if err != nil {
+				r.SendMessage(serviceName, err.Error(), MessageError)
+			} else {
+				err = fn(&s)
+			}
+			if err == nil && r.WarningsAsErrors {
+				err = r.checkWarnings(serviceName)
+			}
+			if err != nil {
+				mu.Lock()
+				errs[serviceName] = err
+				mu.Unlock()
+				if r.FailFast {
+					cancel()
+				}
+			}
+		}(serviceName)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// RunRolling runs fn on the services serviceNames in batches of batchSize
+// services, waiting for a batch to complete before starting the next one. At
+// the first failed batch the rollout is stopped: the remaining services are
+// skipped and the error of the failed batch is returned.
+func (r *Runner) RunRolling(serviceNames []string, batchSize int, fn func(s *Service) error) error {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	for i := 0; i < len(serviceNames); i += batchSize {
+		end := i + batchSize
+		if end > len(serviceNames) {
+			end = len(serviceNames)
+		}
+		err := r.Run(serviceNames[i:end], fn)
+		if err == nil {
+			err = r.ctx.Err()
+		}
+		if err != nil {
+			for _, serviceName := range serviceNames[end:] {
+				r.SendMessage(serviceName, "Skipped: rollout stopped", MessageWarning)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWarnings returns an error if the service serviceName sent warning
+// messages since the start of its Run.
+func (r *Runner) checkWarnings(serviceName string) error {
+	r.mu.Lock()
+	count := r.warnings[serviceName]
+	r.mu.Unlock()
+	if count == 0 {
+		return nil
+	}
+	err := fmt.Errorf("warnings treated as errors: %d", count)
+	r.SendMessage(serviceName, err.Error(), MessageError)
+	return err
+}
+
+// SlowestStep returns the slowest step run by the service serviceName, and
+// false if no step was run.
+func (r *Runner) SlowestStep(serviceName string) (StepTiming, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	step, found := r.slowestSteps[serviceName]
+	return step, found
+}
+
+func (r *Runner) recordStep(serviceName, name string, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if duration >= r.slowestSteps[serviceName].Duration {
+		r.slowestSteps[serviceName] = StepTiming{Name: name, Duration: duration}
+	}
+}
+
+// RunningServices returns the sorted names of the services whose Run call has
+// not finished yet.
+func (r *Runner) RunningServices() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.running))
+	for name := range r.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // StartPrintOutput starts a go routine that read messages from runner channel
 // and prints them.
 func (runner *Runner) StartPrintOutput(services []string) {
+	if runner.handler != nil || runner.eventHandler != nil {
+		return
+	}
 	width := 0
 	for _, serviceName := range services {
 		if len(serviceName) > width {
@@ -224,8 +828,8 @@ func (runner *Runner) StartPrintOutput(services []string) {
 	for {
 		select {
 		case message := <-runner.output:
-			if !runner.QuietMode || message.status == MessageError {
-				message.print(width)
+			if !runner.quiet(message.serviceName) || message.status == MessageError {
+				message.print(runner.out, width)
 			}
 		case <-runner.quit:
 			return
@@ -233,32 +837,147 @@ func (runner *Runner) StartPrintOutput(services []string) {
 	}
 }
 
+// quiet reports whether the non-error messages of the service serviceName are
+// not printed: the service quiet and verbose options override QuietMode.
+func (runner *Runner) quiet(serviceName string) bool {
+	if conf, found := runner.conf[serviceName]; found {
+		if conf.Verbose {
+			return false
+		}
+		if conf.Quiet {
+			return true
+		}
+	}
+	return runner.QuietMode
+}
+
 // StopPrintOutput stop the go routine started with StartPrintOutput.
 func (runner *Runner) StopPrintOutput() {
+	if runner.handler != nil || runner.eventHandler != nil {
+		return
+	}
 	runner.quit <- struct{}{}
 }
 
 // SendMessage writes a message in the runner channel that can be captured and
-// printed by the go routine started with StartPrintOutput.
+// printed by the go routine started with StartPrintOutput. If a MessageHandler
+// is set, the message is passed to it instead.
 func (runner *Runner) SendMessage(serviceName, text string, status MessageStatus) {
-	runner.output <- message{
-		serviceName: serviceName,
-		text:        text,
-		status:      status,
+	runner.send(message{serviceName: serviceName, text: text, status: status, kind: EventMessage})
+}
+
+// send sends m to the event handler, the message handler or the runner
+// channel, tagged with the step in progress of the service. Step events are
+// sent only to the event handler.
+func (runner *Runner) send(m message) {
+	runner.mu.Lock()
+	if m.step == "" {
+		m.step = runner.steps[m.serviceName]
+	}
+	if m.status == MessageWarning {
+		runner.warnings[m.serviceName]++
+	}
+	runner.mu.Unlock()
+	switch {
+	case runner.eventHandler != nil:
+		runner.handlerMu.Lock()
+		runner.eventHandler(Event{ServiceName: m.serviceName, Text: m.text, Status: m.status, Kind: m.kind, Step: m.step, Time: time.Now()})
+		runner.handlerMu.Unlock()
+	case m.kind != EventMessage && m.kind != EventProgress:
+	case runner.handler != nil:
+		runner.handlerMu.Lock()
+		runner.handler(m.serviceName, m.text, m.status, time.Now())
+		runner.handlerMu.Unlock()
+	default:
+		runner.output <- m
+	}
+}
+
+// setStep records step as the step in progress of the service serviceName.
+func (runner *Runner) setStep(serviceName, step string) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if step == "" {
+		delete(runner.steps, serviceName)
+	} else {
+		runner.steps[serviceName] = step
 	}
 }
 
 // Private functions
 
-func readConf(filename string) (map[string]*Conf, error) {
+func readConf(filename, format, environment string) (map[string]*Conf, error) {
 	conf := make(map[string]*Conf)
 
-	buf, err := ioutil.ReadFile(filename)
+	defaults, err := readGlobalDefaults(globalConfPath())
 	if err != nil {
 		return nil, err
 	}
 
-	err = yaml.Unmarshal(buf, conf)
+	if format == "" {
+		format = confFormat(filename)
+	}
+	if format != "yaml" && format != "json" && format != "toml" {
+		return nil, configError("invalid configuration format `%s`: allowed values are `yaml`, `json` or `toml`", format)
+	}
+	var buf []byte
+	if filename == "-" {
+		buf, err = io.ReadAll(os.Stdin)
+	} else {
+		buf, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// JSON is valid YAML, so it is decoded like YAML below, but the JSON decoder
+	// reports the syntax errors in JSON terms
+	if format == "json" {
+		if err := json.Unmarshal(buf, new(map[string]json.RawMessage)); err != nil {
+			return nil, configError("cannot read `%s` file: %s", filename, err)
+		}
+	}
+	if isSopsEncrypted(buf) {
+		buf, err = sopsDecrypt(filename, format, buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// TOML is converted to YAML, so it is decoded like YAML below
+	if format == "toml" {
+		buf, err = tomlToYAML(buf)
+		if err != nil {
+			return nil, configError("cannot read `%s` file: %s", filename, err)
+		}
+	}
+
+	// Each service is decoded over the global defaults, so the options set in
+	// the configuration file win
+	nodes := make(map[string]yaml.Node)
+	err = yaml.Unmarshal(buf, nodes)
+	if err != nil {
+		return nil, &kindError{kind: ErrConfigInvalid, err: err}
+	}
+	environmentFound := false
+	for serviceName, node := range nodes {
+		serviceConf := defaults.Copy()
+		if err := node.Decode(serviceConf); err != nil {
+			return nil, &kindError{kind: ErrConfigInvalid, err: err}
+		}
+		if environment != "" {
+			if overrides := environmentNode(&node, environment); overrides != nil {
+				if err := overrides.Decode(serviceConf); err != nil {
+					return nil, configError("environment `%s` of service `%s`: %s", environment, serviceName, err)
+				}
+				environmentFound = true
+			}
+		}
+		conf[serviceName] = serviceConf
+	}
+	if environment != "" && !environmentFound {
+		return nil, configError("environment `%s` was not found: please add it under `environments` of a service in `%s` file", environment, filename)
+	}
+
+	err = interpolateConf(conf)
 	if err != nil {
 		return nil, err
 	}
@@ -268,6 +987,172 @@ func readConf(filename string) (map[string]*Conf, error) {
 	return conf, nil
 }
 
+// environmentNode returns the node under environments.<environment> of the
+// service node, or nil if not found.
+func environmentNode(node *yaml.Node, environment string) *yaml.Node {
+	find := func(node *yaml.Node, key string) *yaml.Node {
+		for node.Kind == yaml.AliasNode {
+			node = node.Alias
+		}
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return node.Content[i+1]
+			}
+		}
+		return nil
+	}
+	environments := find(node, "environments")
+	if environments == nil {
+		return nil
+	}
+	return find(environments, environment)
+}
+
+// tomlToYAML returns the TOML document buf as a YAML document.
+func tomlToYAML(buf []byte) ([]byte, error) {
+	var document map[string]interface{}
+	if err := toml.Unmarshal(buf, &document); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(document)
+}
+
+// confFormat returns the format of the configuration file filename from its
+// extension: json, toml or, by default, yaml.
+func confFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return "json"
+	case ".toml":
+		return "toml"
+	}
+	return "yaml"
+}
+
+// globalConfPath returns the path of the user configuration file,
+// $XDG_CONFIG_HOME/god/config.yml or ~/.config/god/config.yml, or an empty
+// string if the home directory is unknown.
+func globalConfPath() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "god", "config.yml")
+}
+
+// readGlobalDefaults returns the options under the `defaults` key of the user
+// configuration file filename, applied to all services of every configuration
+// file. If the file does not exist, the defaults are empty.
+func readGlobalDefaults(filename string) (*Conf, error) {
+	var global struct {
+		Defaults Conf `yaml:"defaults"`
+	}
+	if filename == "" {
+		return &global.Defaults, nil
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &global.Defaults, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(buf, &global)
+	if err != nil {
+		return nil, configError("invalid `%s` file: %s", filename, err)
+	}
+	return &global.Defaults, nil
+}
+
+var conditionNameRegExp = regexp.MustCompile(`^[A-Za-z][A-Za-z_]*$`)
+
+var unitNameRegExp = regexp.MustCompile(`^[A-Za-z0-9:_.@-]+$`)
+
+var fileModeRegExp = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+var interpolationRegExp = regexp.MustCompile(`\$(\$?)\{([^}]*)\}`)
+
+// interpolateConf replaces ${VAR} in all string values with the value of the
+// local environment variable VAR. ${VAR:-default} uses default when VAR is not
+// set, and $${VAR} is left as the literal ${VAR}. An undefined variable without
+// default is an error.
+func interpolateConf(conf map[string]*Conf) error {
+	for serviceName, value := range conf {
+		reflectValue := reflect.ValueOf(value).Elem()
+		for i := 0; i < reflectValue.NumField(); i++ {
+			yamlTagValue := reflectValue.Type().Field(i).Tag.Get("yaml")
+			// Conditions read the variables when evaluated
+			if yamlTagValue == "skip_if" || yamlTagValue == "only_if" {
+				continue
+			}
+			fieldValue := reflectValue.Field(i)
+			var err error
+			switch fieldValue.Kind() {
+			case reflect.String:
+				var expanded string
+				expanded, err = interpolate(fieldValue.String())
+				fieldValue.SetString(expanded)
+			case reflect.Slice:
+				for j := 0; j < fieldValue.Len() && err == nil; j++ {
+					err = interpolateValue(fieldValue.Index(j))
+				}
+			}
+			if err != nil {
+				return configError("configuration `%s` of service `%s`: %s", yamlTagValue, serviceName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// interpolateValue interpolates value if it is a string, or its string fields
+// if it is a struct.
+func interpolateValue(value reflect.Value) error {
+	switch value.Kind() {
+	case reflect.String:
+		expanded, err := interpolate(value.String())
+		value.SetString(expanded)
+		return err
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if err := interpolateValue(value.Field(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func interpolate(value string) (string, error) {
+	var err error
+	result := interpolationRegExp.ReplaceAllStringFunc(value, func(match string) string {
+		submatch := interpolationRegExp.FindStringSubmatch(match)
+		if submatch[1] != "" {
+			return match[1:]
+		}
+		name, defaultValue, hasDefault := strings.Cut(submatch[2], ":-")
+		envValue, found := os.LookupEnv(name)
+		if found && (envValue != "" || !hasDefault) {
+			return envValue
+		}
+		if hasDefault {
+			return defaultValue
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable `%s` is not set: please set it or use `${%s:-<default>}`", name, name)
+		}
+		return ""
+	})
+	return result, err
+}
+
 func loadConfFromEnv(conf map[string]*Conf) {
 	for serviceName, value := range conf {
 		reflectValue := reflect.ValueOf(value).Elem()
@@ -295,14 +1180,111 @@ func loadConfFromEnv(conf map[string]*Conf) {
 
 func (r *Runner) validateConf(conf *Conf) error {
 	if conf.Host == "" {
-		return fmt.Errorf("required configuration `host` value is missing: please add `host: <hostname>` in `%s` file", r.confFilePath)
+		return configError("required configuration `host` value is missing: please add `host: <hostname>` in `%s` file", r.confFilePath)
 	}
 	if conf.GoInstall == "" {
-		return fmt.Errorf("required configuration `go_install` value is missing: please add `go_install: <package>` in `%s` file", r.confFilePath)
+		return configError("required configuration `go_install` value is missing: please add `go_install: <package>` in `%s` file", r.confFilePath)
+	}
+	for _, pkg := range conf.ExtraInstalls {
+		if getExec(pkg) == "" {
+			return configError("invalid configuration `extra_installs` package `%s`: package path must have the version suffix, ex: @latest in `%s` file", pkg, r.confFilePath)
+		}
+	}
+	if _, found := initSystems[conf.InitSystem]; conf.InitSystem != "" && !found {
+		return configError("invalid configuration `init_system` value `%s`: allowed values are `systemd`, `openrc` or `runit` in `%s` file", conf.InitSystem, r.confFilePath)
+	}
+	if conf.UnitName != "" && !unitNameRegExp.MatchString(conf.UnitName) {
+		return configError("invalid configuration `unit_name` value `%s`: use only letters, digits and the characters `:-_.@` in `%s` file", conf.UnitName, r.confFilePath)
+	}
+	if conf.WorkingDirectoryMode != "" && !fileModeRegExp.MatchString(conf.WorkingDirectoryMode) {
+		return configError("invalid configuration `working_directory_mode` value `%s`: use octal permissions, ex: '0700' in `%s` file", conf.WorkingDirectoryMode, r.confFilePath)
+	}
+	// The commands are templates of the configuration variables
+	service := Service{Conf: conf}
+	for _, option := range [][2]string{{"build_command", conf.BuildCommand}, {"exec_condition", conf.ExecCondition}, {"post_install", conf.PostInstall}} {
+		if _, err := service.ParseCommand(option[1]); err != nil {
+			return configError("invalid configuration `%s` value `%s`: %s in `%s` file", option[0], option[1], err, r.confFilePath)
+		}
+	}
+	for name := range conf.Conditions {
+		if !conditionNameRegExp.MatchString(name) {
+			return configError("invalid configuration `conditions` name `%s`: use the name of a systemd condition without the Condition prefix, ex: path_exists in `%s` file", name, r.confFilePath)
+		}
+	}
+	switch conf.ServiceType {
+	case "", "simple", "exec", "notify", "forking":
+	default:
+		return configError("invalid configuration `service_type` value `%s`: allowed values are `simple`, `exec`, `notify` or `forking` in `%s` file", conf.ServiceType, r.confFilePath)
+	}
+	switch conf.RunMode {
+	case "", "install", "go-run":
+	default:
+		return configError("invalid configuration `run_mode` value `%s`: allowed values are `install` or `go-run` in `%s` file", conf.RunMode, r.confFilePath)
+	}
+	switch conf.UseMise {
+	case "", "auto", "true", "false":
+	default:
+		return configError("invalid configuration `use_mise` value `%s`: allowed values are `auto`, `true` or `false` in `%s` file", conf.UseMise, r.confFilePath)
 	}
 	return nil
 }
 
+// defaultExecStart returns the command that starts the service if exec_start
+// is not set: the executable installed by go install, or go run of the package
+// in go-run mode. Returns an empty string if the executable name is unknown.
+func defaultExecStart(conf *Conf) string {
+	if conf.RunMode == "go-run" {
+		return conf.GoExecPath + " run " + strings.SplitN(conf.GoInstall, "@", 2)[0]
+	}
+	exec := getExec(conf.GoInstall)
+	if exec == "" {
+		return ""
+	}
+	return filepath.Join(conf.GoBinDirectory, exec)
+}
+
+// resolveLogPath returns log_path with the configuration variables and
+// {{.Name}}, the service name, replaced, and a leading ~ replaced with home, so
+// that log_path can be shared by many services, ex: '~/logs/{{.Name}}.log'.
+func resolveLogPath(conf *Conf, serviceName, home string) (string, error) {
+	if !strings.Contains(conf.LogPath, "{{") && !strings.HasPrefix(conf.LogPath, "~") {
+		return conf.LogPath, nil
+	}
+	tmpl, err := template.New("logPath").Parse(conf.LogPath)
+	if err != nil {
+		return "", err
+	}
+	var logPath strings.Builder
+	data := struct {
+		*Conf
+		Name string
+	}{conf, serviceName}
+	if err := tmpl.Execute(&logPath, data); err != nil {
+		return "", err
+	}
+	path := logPath.String()
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		path = home + path[1:]
+	}
+	return path, nil
+}
+
+// absoluteExecStart returns exec_start with a relative executable path made
+// absolute, since systemd requires it: a bare executable name is resolved
+// against go_bin_directory and a path against the working directory.
+// Executables starting with a systemd specifier or prefix are left untouched.
+func absoluteExecStart(conf *Conf) string {
+	executable := execPath(conf.ExecStart)
+	if executable == "" || strings.ContainsAny(executable[:1], "/%-@+!:") {
+		return conf.ExecStart
+	}
+	dir := conf.WorkingDirectory
+	if !strings.Contains(executable, "/") {
+		dir = conf.GoBinDirectory
+	}
+	return filepath.Join(dir, executable) + strings.TrimPrefix(strings.TrimSpace(conf.ExecStart), executable)
+}
+
 var packageRegExp = regexp.MustCompile(`\/?([-_\w]+)@.*`)
 
 func getExec(packageName string) string {
@@ -0,0 +1,430 @@
+package runner
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pioz/god/sshcmd"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an SSH server that runs no command: it replies to the
+// commands run by MakeService with the output of a remote host where the user
+// home is /home/god, and to the other commands with no output.
+type testServer struct {
+	port        string
+	connections int32
+	// If not zero, the connections are closed before the handshake
+	refuse int32
+	mu     sync.Mutex
+	conns  []net.Conn
+}
+
+var testServerOutputs = map[string]string{
+	"echo $HOME":   "/home/god\n",
+	"go env GOBIN": "/home/god/go/bin\n",
+	"which go":     "/usr/local/go/bin/go\n",
+
+	"sha256sum '/home/god/go/bin/app'": "0123abcd  /home/god/go/bin/app\n",
+}
+
+// startTestServer starts a testServer listening on a random port of
+// 127.0.0.1, stopped at the end of the test.
+func startTestServer(t *testing.T) *testServer {
+	t.Helper()
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := &testServer{port: fmt.Sprint(listener.Addr().(*net.TCPAddr).Port)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if atomic.LoadInt32(&server.refuse) != 0 {
+				conn.Close()
+				continue
+			}
+			atomic.AddInt32(&server.connections, 1)
+			server.mu.Lock()
+			server.conns = append(server.conns, conn)
+			server.mu.Unlock()
+			go server.serve(conn, config)
+		}
+	}()
+	return server
+}
+
+// dropConnections closes the open connections, like a network failure.
+func (server *testServer) dropConnections() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+	server.conns = nil
+}
+
+func (server *testServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer channel.Close()
+			for request := range requests {
+				if request.Type != "exec" {
+					request.Reply(false, nil)
+					continue
+				}
+				var payload struct{ Command string }
+				ssh.Unmarshal(request.Payload, &payload)
+				request.Reply(true, nil)
+				channel.Write([]byte(testServerOutputs[payload.Command]))
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				return
+			}
+		}()
+	}
+}
+
+// writeTestPrivateKey writes a new private key in dir and returns its path.
+func writeTestPrivateKey(t *testing.T, dir string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "id_ecdsa")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// makeTestRunner returns a Runner reading the configuration conf, where
+// {{key}} is replaced with the path of a private key accepted by the test
+// servers. The user configuration file is ignored.
+func makeTestRunner(t *testing.T, conf string) *Runner {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	confPath := filepath.Join(dir, "god.yml")
+	conf = strings.ReplaceAll(conf, "{{key}}", writeTestPrivateKey(t, dir))
+	if err := os.WriteFile(confPath, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := MakeRunner(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetMessageHandler(func(serviceName, text string, status MessageStatus, t time.Time) {})
+	return r
+}
+
+func TestMakeServiceConcurrently(t *testing.T) {
+	servers := []*testServer{startTestServer(t), startTestServer(t)}
+	var conf strings.Builder
+	var serviceNames []string
+	for i, server := range servers {
+		for j := 0; j < 5; j++ {
+			serviceName := fmt.Sprintf("service_%d_%d", i, j)
+			serviceNames = append(serviceNames, serviceName)
+			fmt.Fprintf(&conf, "%s:\n  user: god\n  host: 127.0.0.1\n  port: %s\n  private_key_path: {{key}}\n  go_install: example.com/%s@latest\n", serviceName, server.port, serviceName)
+		}
+	}
+	r := makeTestRunner(t, conf.String())
+
+	// Each service is made by many go routines at the same time
+	services := make([][]Service, len(serviceNames))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i, serviceName := range serviceNames {
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(i int, serviceName string) {
+				defer wg.Done()
+				s, err := r.MakeService(serviceName)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				services[i] = append(services[i], s)
+				mu.Unlock()
+			}(i, serviceName)
+		}
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	for i, server := range servers {
+		if connections := atomic.LoadInt32(&server.connections); connections != 1 {
+			t.Errorf("server %d: got %d connections, want 1", i, connections)
+		}
+	}
+	clients := make(map[string]*sshcmd.Client)
+	for i, serviceName := range serviceNames {
+		port := r.conf[serviceName].Port
+		for _, s := range services[i] {
+			if client, found := clients[port]; found && client != s.client {
+				t.Errorf("service %s: got a different client for port %s", serviceName, port)
+			}
+			clients[port] = s.client
+			if s.Conf == r.conf[serviceName] {
+				t.Errorf("service %s: the loaded configuration is shared", serviceName)
+			}
+			if want := "/home/god/go/bin/" + serviceName; s.Conf.ExecStart != want {
+				t.Errorf("service %s: got exec_start %q, want %q", serviceName, s.Conf.ExecStart, want)
+			}
+		}
+		if loaded := r.conf[serviceName]; loaded.GoBinDirectory != "" || loaded.ExecStart != "" {
+			t.Errorf("service %s: the loaded configuration was changed", serviceName)
+		}
+	}
+	if len(clients) != len(servers) {
+		t.Errorf("got %d clients, want %d", len(clients), len(servers))
+	}
+}
+
+func TestMakeServiceSeparatesPorts(t *testing.T) {
+	first, second := startTestServer(t), startTestServer(t)
+	r := makeTestRunner(t, fmt.Sprintf(`first:
+  user: god
+  host: 127.0.0.1
+  port: %s
+  private_key_path: {{key}}
+  go_install: example.com/first@latest
+second:
+  user: god
+  host: 127.0.0.1
+  port: %s
+  private_key_path: {{key}}
+  go_install: example.com/second@latest
+`, first.port, second.port))
+
+	s1, err := r.MakeService("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := r.MakeService("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s1.client == s2.client {
+		t.Error("services on the same host with different ports share a client")
+	}
+	if connections := atomic.LoadInt32(&first.connections); connections != 1 {
+		t.Errorf("first server: got %d connections, want 1", connections)
+	}
+	if connections := atomic.LoadInt32(&second.connections); connections != 1 {
+		t.Errorf("second server: got %d connections, want 1", connections)
+	}
+}
+
+func TestMakeServiceReconnects(t *testing.T) {
+	server := startTestServer(t)
+	r := makeTestRunner(t, `app:
+  user: god
+  host: 127.0.0.1
+  port: `+server.port+`
+  private_key_path: {{key}}
+  go_install: example.com/app@latest
+`)
+
+	// A failed dial is not reused
+	atomic.StoreInt32(&server.refuse, 1)
+	if _, err := r.MakeService("app"); err == nil {
+		t.Fatal("got no error with the connection refused")
+	}
+	atomic.StoreInt32(&server.refuse, 0)
+	s, err := r.MakeService("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connections := atomic.LoadInt32(&server.connections); connections != 1 {
+		t.Errorf("got %d connections, want 1", connections)
+	}
+
+	// A dropped connection is replaced
+	server.dropConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.client.Closed() {
+		if time.Now().After(deadline) {
+			t.Fatal("the dropped connection is not reported as closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	reconnected, err := r.MakeService("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reconnected.client == s.client {
+		t.Error("got the dropped client")
+	}
+	if _, err := reconnected.Exec("echo $HOME"); err != nil {
+		t.Error(err)
+	}
+	if connections := atomic.LoadInt32(&server.connections); connections != 2 {
+		t.Errorf("got %d connections, want 2", connections)
+	}
+}
+
+func TestRunSeparatesContexts(t *testing.T) {
+	server := startTestServer(t)
+	r := makeTestRunner(t, `failing:
+  user: god
+  host: 127.0.0.1
+  port: `+server.port+`
+  private_key_path: {{key}}
+  go_install: example.com/failing@latest
+other:
+  user: god
+  host: 127.0.0.1
+  port: `+server.port+`
+  private_key_path: {{key}}
+  go_install: example.com/other@latest
+`)
+	r.FailFast = true
+
+	// The failure of a run cancels its services only, not the ones of an
+	// overlapping run
+	failed := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- r.Run([]string{"other"}, func(s *Service) error {
+			<-failed
+			if err := s.runContext().Err(); err != nil {
+				return err
+			}
+			_, err := s.Exec("echo $HOME")
+			return err
+		})
+	}()
+	if err := r.Run([]string{"failing"}, func(s *Service) error { return errors.New("failed") }); err == nil {
+		t.Error("failing: got no error")
+	}
+	close(failed)
+	if err := <-done; err != nil {
+		t.Errorf("other: %s", err)
+	}
+	if err := r.ctx.Err(); err != nil {
+		t.Errorf("runner context: %s", err)
+	}
+}
+
+func TestReadConfFormats(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("GIT_SHA", "0123abc")
+	files := map[string]string{
+		"god.yml": `app:
+  host: example.com
+  port: 2222
+  go_install: example.com/app@latest
+  environment: GIT_SHA=${GIT_SHA}
+  environments:
+    prod:
+      host: prod.example.com
+`,
+		"god.json": `{"app": {
+  "host": "example.com",
+  "port": 2222,
+  "go_install": "example.com/app@latest",
+  "environment": "GIT_SHA=${GIT_SHA}",
+  "environments": {"prod": {"host": "prod.example.com"}}
+}}`,
+		"god.toml": `[app]
+host = "example.com"
+port = 2222
+go_install = "example.com/app@latest"
+environment = "GIT_SHA=${GIT_SHA}"
+
+[app.environments.prod]
+host = "prod.example.com"
+`,
+	}
+	dir := t.TempDir()
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			conf, err := readConf(path, "", "prod")
+			if err != nil {
+				t.Fatal(err)
+			}
+			app := conf["app"]
+			if app == nil {
+				t.Fatal("service app not found")
+			}
+			if app.Host != "prod.example.com" || app.Port != "2222" || app.GoInstall != "example.com/app@latest" || app.Environment != "GIT_SHA=0123abc" {
+				t.Errorf("got host %q, port %q, go_install %q, environment %q", app.Host, app.Port, app.GoInstall, app.Environment)
+			}
+		})
+	}
+
+	// The format hint wins over the extension
+	path := filepath.Join(dir, "god.conf")
+	if err := os.WriteFile(path, []byte(files["god.toml"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readConf(path, "", ""); err == nil {
+		t.Error("TOML read as YAML: got no error")
+	}
+	if conf, err := readConf(path, "toml", ""); err != nil {
+		t.Error(err)
+	} else if conf["app"] == nil || conf["app"].Host != "example.com" {
+		t.Errorf("TOML read with the format hint: got %v", conf)
+	}
+	if _, err := readConf(path, "ini", ""); err == nil {
+		t.Error("unknown format: got no error")
+	}
+}
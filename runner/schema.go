@@ -0,0 +1,119 @@
+package runner
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Values allowed by the configuration options with a fixed set of values.
+var confEnums = map[string][]string{
+	"init_system":  {"systemd", "openrc", "runit"},
+	"use_mise":     {"auto", "true", "false"},
+	"service_type": {"simple", "exec", "notify", "forking"},
+	"run_mode":     {"install", "go-run"},
+}
+
+// Configuration options with a fixed set of values that also accept the
+// booleans true and false.
+var confBooleanEnums = map[string]bool{
+	"use_mise": true,
+}
+
+// Required configuration options. The host is not required, as it can be set
+// in the user configuration file defaults or with an env variable.
+var confRequired = []string{"go_install"}
+
+// JSONSchema returns the JSON Schema of the YAML configuration file, built
+// from the Conf fields. descriptions maps the option names to their
+// description.
+func JSONSchema(descriptions map[string]string) map[string]interface{} {
+	properties := make(map[string]interface{})
+	confType := reflect.TypeOf(Conf{})
+	for i := 0; i < confType.NumField(); i++ {
+		field := confType.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			continue
+		}
+		property := jsonSchemaType(field.Type)
+		if enum, found := confEnums[name]; found {
+			property["enum"] = enum
+			if confBooleanEnums[name] {
+				property = map[string]interface{}{
+					"oneOf": []interface{}{property, map[string]interface{}{"type": "boolean"}},
+				}
+			}
+		}
+		if description, found := descriptions[name]; found {
+			property["description"] = description
+		}
+		properties[name] = property
+	}
+	// Environments override any option but required ones are not required
+	overrides := make(map[string]interface{}, len(properties))
+	for name, property := range properties {
+		overrides[name] = property
+	}
+	environments := map[string]interface{}{
+		"type": "object",
+		"additionalProperties": map[string]interface{}{
+			"type":                 "object",
+			"properties":           overrides,
+			"additionalProperties": false,
+		},
+	}
+	if description, found := descriptions["environments"]; found {
+		environments["description"] = description
+	}
+	properties["environments"] = environments
+	return map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "God configuration file",
+		"description": "Services managed by god, keyed by service name.",
+		"type":        "object",
+		"additionalProperties": map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"required":             confRequired,
+			"additionalProperties": false,
+		},
+	}
+}
+
+func jsonSchemaType(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(CopyFile{}) {
+		fields := jsonSchemaObject(t)
+		fields["required"] = []string{"path"}
+		return map[string]interface{}{
+			"oneOf": []interface{}{map[string]interface{}{"type": "string"}, fields},
+		}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchemaType(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": jsonSchemaType(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchemaType(t.Elem())}
+	case reflect.Struct:
+		return jsonSchemaObject(t)
+	}
+	return map[string]interface{}{}
+}
+
+func jsonSchemaObject(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name != "" {
+			properties[name] = jsonSchemaType(t.Field(i).Type)
+		}
+	}
+	return map[string]interface{}{"type": "object", "properties": properties, "additionalProperties": false}
+}
@@ -0,0 +1,47 @@
+package runner
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJSONSchema(t *testing.T) {
+	schema := JSONSchema(map[string]string{"use_mise": "Use mise."})
+	service := schema["additionalProperties"].(map[string]interface{})
+	if required := service["required"]; !reflect.DeepEqual(required, []string{"go_install"}) {
+		t.Errorf("got required %v, want [go_install]", required)
+	}
+	useMise := service["properties"].(map[string]interface{})["use_mise"].(map[string]interface{})
+	want := map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string", "enum": []string{"auto", "true", "false"}},
+			map[string]interface{}{"type": "boolean"},
+		},
+		"description": "Use mise.",
+	}
+	if !reflect.DeepEqual(useMise, want) {
+		t.Errorf("got use_mise %v, want %v", useMise, want)
+	}
+}
+
+func TestReadConfBooleanUseMise(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "god.yml")
+	content := "app:\n  host: example.com\n  go_install: example.com/app@latest\n  use_mise: false\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := MakeRunner(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := r.ResolveConf("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.UseMise != "false" {
+		t.Errorf("got use_mise %q, want false", conf.UseMise)
+	}
+}
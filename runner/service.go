@@ -2,15 +2,22 @@ package runner
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"html/template"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"text/template"
 
 	"github.com/pioz/god/sshcmd"
+	"github.com/pkg/sftp"
 )
 
 // Service represents a service that will be installed and launched on the
@@ -24,12 +31,51 @@ type Service struct {
 	client        *sshcmd.Client
 	runner        *Runner
 	remoteHomeDir string
+	// Context of the run of the service. If nil, the runner context is used.
+	ctx context.Context
+	// Configuration used to generate the service file, with the systemd
+	// specifiers not expanded. If nil, Conf is used.
+	unitConf *Conf
 }
 
-// Exec runs cmd on the remote host.
+// runContext returns the context of the run of the service: when it is done,
+// no more remote commands are run.
+func (service *Service) runContext() context.Context {
+	if service.ctx != nil {
+		return service.ctx
+	}
+	return service.runner.ctx
+}
+
+// Exec runs cmd on the remote host. If cmd exits with a non-zero status, the
+// error is a *RemoteCommandError. If a `systemctl --user` command cannot
+// connect to the user bus, it is retried setting the default XDG_RUNTIME_DIR
+// and DBUS_SESSION_BUS_ADDRESS of the user, as non-login SSH sessions might
+// not have them.
 func (service *Service) Exec(cmd string) (string, error) {
-	output, err := service.client.Exec(cmd)
-	return strings.TrimSuffix(output, "\n"), err
+	return service.ExecInput(cmd, nil)
+}
+
+// ExecInput is like Exec, but the standard input of cmd reads from stdin.
+func (service *Service) ExecInput(cmd string, stdin io.Reader) (string, error) {
+	output, err := service.client.ExecInput(service.runContext(), cmd, stdin)
+	if err != nil && strings.HasPrefix(cmd, "systemctl --user") && isBusError(output) {
+		output, err = service.client.ExecContext(service.runContext(), userBusEnv+cmd)
+		if err != nil && isBusError(output) {
+			output = fmt.Sprintf("the systemd user instance of `%s` is not running: enable lingering with `sudo loginctl enable-linger %s` or start it with `sudo systemctl start user@$(id -u %s).service`", service.Conf.User, service.Conf.User, service.Conf.User)
+		}
+	}
+	if err != nil && service.runContext().Err() != nil {
+		output = err.Error()
+	}
+	output = strings.TrimSuffix(output, "\n")
+	return output, remoteCommandError(cmd, output, err)
+}
+
+const userBusEnv = "XDG_RUNTIME_DIR=/run/user/$(id -u) DBUS_SESSION_BUS_ADDRESS=unix:path=/run/user/$(id -u)/bus "
+
+func isBusError(output string) bool {
+	return strings.Contains(output, "Failed to connect to bus") || strings.Contains(output, "$DBUS_SESSION_BUS_ADDRESS and $XDG_RUNTIME_DIR not defined")
 }
 
 // PrintExec runs cmd on the remote host and sends the output on the runner
@@ -52,15 +98,29 @@ func (service *Service) PrintExec(cmd, errorMessage string) error {
 }
 
 // ParseCommand parses the cmd string replacing the variables with those present
-// in the configuration.
-func (service *Service) ParseCommand(cmd string) string {
+// in the configuration. Returns an error if cmd is not a valid template or
+// references an unknown variable.
+func (service *Service) ParseCommand(cmd string) (string, error) {
 	tmpl, err := template.New("command").Parse(cmd)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	var parsedCommand bytes.Buffer
-	tmpl.Execute(&parsedCommand, service.Conf)
-	return parsedCommand.String()
+	if err := tmpl.Execute(&parsedCommand, service.Conf); err != nil {
+		return "", err
+	}
+	return parsedCommand.String(), nil
+}
+
+// mustParseCommand is like ParseCommand for the commands written in god, whose
+// templates are always valid. Never pass it a command from the configuration or
+// the command line.
+func (service *Service) mustParseCommand(cmd string) string {
+	parsedCommand, err := service.ParseCommand(cmd)
+	if err != nil {
+		panic(err)
+	}
+	return parsedCommand
 }
 
 // CopyFile copies the local file on the remote host to the remote
@@ -73,6 +133,9 @@ func (service *Service) CopyFile(path, workingDirectory string) error {
 	}
 
 	return service.client.WalkDir(path, workingDirectory, func(localPath, remotePath string, info fs.DirEntry, e error) error {
+		if err := service.runContext().Err(); err != nil {
+			return err
+		}
 		if info.IsDir() {
 			return service.client.SftClient.MkdirAll(remotePath)
 		}
@@ -80,38 +143,81 @@ func (service *Service) CopyFile(path, workingDirectory string) error {
 		if err != nil {
 			return err
 		}
+		defer srcFile.Close()
 
-		dstFile, err := service.client.SftClient.Create(remotePath)
+		stat, err := srcFile.Stat()
 		if err != nil {
 			return err
 		}
-		defer dstFile.Close()
-
-		_, err = dstFile.ReadFrom(srcFile)
-		return err
+		if !service.Conf.CompressUploads {
+			return service.uploadResumableFile(remotePath, localPath, srcFile, stat.Size())
+		}
+		if stat.Size() < progressMinSize {
+			return service.uploadCompressedFile(remotePath, srcFile, 0)
+		}
+		return service.uploadCompressedFile(remotePath, service.newProgressReader(localPath, srcFile, stat.Size(), 0), 0)
 	})
 }
 
+// newProgressReader returns a progressReader of reader that sends the upload
+// progress of localPath, whose first offset bytes are already uploaded.
+func (service *Service) newProgressReader(localPath string, reader io.Reader, size, offset int64) *progressReader {
+	percent := offset * 100 / size
+	return &progressReader{
+		reader:   reader,
+		size:     size,
+		read:     offset,
+		reported: percent - percent%10,
+		report: func(percent int64) {
+			service.runner.send(message{serviceName: service.Name, text: fmt.Sprintf("uploaded %d%% of %s", percent, localPath), status: MessageNormal, kind: EventProgress})
+		},
+	}
+}
+
 // DeleteFile deletes the file on the remote host relative to the remote
-// workingDirectory.
+// workingDirectory, and the files left by its interrupted uploads. The files
+// already missing are ignored. Returns an error listing the files that cannot
+// be deleted.
 func (service *Service) DeleteFile(path, workingDirectory string) error {
-	var directories []string
+	var directories, failures []string
 	err := service.client.ConnectSftpClient()
 	if err != nil {
 		return err
 	}
+	remove := func(remove func(string) error, remotePath string) {
+		err := remove(remotePath)
+		if statusErr, ok := err.(*sftp.StatusError); ok && statusErr.Code == 4 { // sshFxFailure
+			err = errors.New("directory is not empty")
+		}
+		if err != nil && !os.IsNotExist(err) {
+			failures = append(failures, fmt.Sprintf("%s: %s", remotePath, err))
+		}
+	}
 	err = service.client.WalkDir(path, workingDirectory, func(localPath, remotePath string, info fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
 		if info.IsDir() {
 			directories = append(directories, remotePath)
 		} else {
-			service.client.SftClient.Remove(remotePath)
+			remove(service.client.SftClient.Remove, remotePath)
+			// Left by an interrupted upload
+			tmpPath, checksumPath := resumePaths(remotePath)
+			remove(service.client.SftClient.Remove, tmpPath)
+			remove(service.client.SftClient.Remove, checksumPath)
 		}
 		return nil
 	})
+	if err != nil {
+		failures = append(failures, err.Error())
+	}
 	for i := len(directories) - 1; i >= 0; i-- {
-		service.client.SftClient.RemoveDirectory(directories[i])
+		remove(service.client.SftClient.RemoveDirectory, directories[i])
 	}
-	return err
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
 }
 
 // CopyUnitServiceFile copies the systemd unit service file on the remote host.
@@ -121,32 +227,96 @@ func (service *Service) CopyUnitServiceFile() error {
 		return err
 	}
 
+	// Never overwrite service files written by hand
+	installed, err := service.ReadUnitServiceFile()
+	if err == nil && !service.isManagedServiceFile(installed) {
+		return fmt.Errorf("service file `%s` was not written by god: remove it to install the service", service.serviceFilePath())
+	}
+
 	var buf bytes.Buffer
-	service.GenerateServiceFile(&buf)
+	if err := service.GenerateServiceFile(&buf); err != nil {
+		return err
+	}
 
-	// Create the destination file
-	filename := filepath.Join(service.Conf.SystemdServicesDirectory, fmt.Sprintf("%s.service", service.Name))
-	dstFile, err := service.client.SftClient.Create(filename)
+	filename := service.serviceFilePath()
+	err = service.client.SftClient.MkdirAll(filepath.Dir(filename))
 	if err != nil {
 		return err
 	}
-	defer dstFile.Close()
+	var mode os.FileMode
+	if service.initSystem().executable {
+		mode = 0755
+	}
+	return service.uploadFile(filename, &buf, mode)
+}
 
-	// write to file
-	if _, err := dstFile.ReadFrom(&buf); err != nil {
-		return err
+// ReadUnitServiceFile reads the systemd unit service file installed on the
+// remote host.
+func (service *Service) ReadUnitServiceFile() (string, error) {
+	err := service.client.ConnectSftpClient()
+	if err != nil {
+		return "", err
 	}
-	return nil
+
+	srcFile, err := service.client.SftClient.Open(service.serviceFilePath())
+	if err != nil {
+		return "", err
+	}
+	defer srcFile.Close()
+
+	var buf bytes.Buffer
+	if _, err := srcFile.WriteTo(&buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// UnitServiceFileChanged reports whether the systemd unit service file
+// installed on the remote host differs from the one generated using the
+// current service configuration.
+func (service *Service) UnitServiceFileChanged() (bool, error) {
+	installed, err := service.ReadUnitServiceFile()
+	if err != nil {
+		return false, err
+	}
+	var buf bytes.Buffer
+	if err := service.GenerateServiceFile(&buf); err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(installed) != strings.TrimSpace(buf.String()), nil
 }
 
 // GenerateServiceFile generates the systemd unit service file using the service
-// configuration.
-func (service *Service) GenerateServiceFile(buf io.Writer) {
-	tmpl, err := template.New("serviceFile").Parse(fmt.Sprintf(serviceTemplate, service.Name))
+// configuration. Returns an error if a configuration value used as a template,
+// like exec_condition, is not valid.
+func (service *Service) GenerateServiceFile(buf io.Writer) error {
+	funcs := template.FuncMap{
+		"trim":         strings.TrimSpace,
+		"execPath":     execPath,
+		"execArgs":     func(cmd string) string { return strings.Join(strings.Fields(cmd)[1:], " ") },
+		"parseCommand": service.ParseCommand,
+		"conditionName": func(name string) string {
+			// path_exists -> PathExists
+			words := strings.Split(name, "_")
+			for i, word := range words {
+				if word != "" {
+					words[i] = strings.ToUpper(word[:1]) + word[1:]
+				}
+			}
+			return strings.Join(words, "")
+		},
+		"systemdEnvironment": systemdEnvironment,
+		"shellEnvironment":   shellEnvironment,
+	}
+	tmpl, err := template.New("serviceFile").Funcs(funcs).Parse(fmt.Sprintf(service.initSystem().serviceTemplate, service.unitName(), service.managedMarkerLine()))
 	if err != nil {
-		panic(err)
+		return err
+	}
+	conf := service.Conf
+	if service.unitConf != nil {
+		conf = service.unitConf
 	}
-	tmpl.Execute(buf, service.Conf)
+	return tmpl.Execute(buf, conf)
 }
 
 // DeleteDirIfEmpty deletes remote directory only if empty.
@@ -158,35 +328,426 @@ func (service *Service) DeleteDirIfEmpty(dirPath string) error {
 	return service.client.SftClient.Remove(dirPath)
 }
 
-const serviceTemplate = `[Unit]
-Description=%s
-{{- if .RunAfterService}}
-After={{.RunAfterService}}
-{{- end}}
-{{- if .StartLimitBurst}}
-StartLimitBurst={{.StartLimitBurst}}
-{{- end}}
-{{- if .StartLimitIntervalSec}}
-StartLimitIntervalSec={{.StartLimitIntervalSec}}
-{{- end}}
-
-[Service]
-Type=simple
-Restart=always
-{{- if .RestartSec}}
-RestartSec={{.RestartSec}}
-{{- end}}
-{{- if .Environment}}
-Environment={{.Environment}}
-{{- end}}
-{{- if .LogPath}}
-StandardOutput=append:{{.LogPath}}
-{{- end}}
-{{- if .LogPath}}
-StandardError=append:{{.LogPath}}
-{{- end}}
-WorkingDirectory={{.WorkingDirectory}}
-ExecStart={{.ExecStart}}
-
-[Install]
-WantedBy=default.target`
+// uploadFile writes the content of src in the remote file remotePath. The
+// content is written in a temporary sibling file, renamed into place on
+// success, so remotePath is never left partially written. If mode is not zero,
+// it is set as the file permissions before the rename.
+func (service *Service) uploadFile(remotePath string, src io.Reader, mode os.FileMode) error {
+	tmpPath := filepath.Join(filepath.Dir(remotePath), fmt.Sprintf(".%s.tmp", filepath.Base(remotePath)))
+	dstFile, err := service.client.SftClient.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if mode != 0 {
+		err = dstFile.Chmod(mode)
+	}
+	if err == nil {
+		err = service.writeFile(dstFile, src)
+	}
+	closeErr := dstFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = service.client.SftClient.PosixRename(tmpPath, remotePath)
+	}
+	if err != nil {
+		service.client.SftClient.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// Bytes of a partially uploaded file that are uploaded again on resume. With
+// concurrent writes, the requests in flight when the upload was interrupted
+// can leave holes at the end of the file: the sftp client sends at most 64
+// requests of 32 KiB at the same time.
+const resumeMargin = 64 * 32 << 10 // 2 MiB
+
+// resumePaths returns the temporary file where remotePath is uploaded and its
+// checksum sidecar file, kept next to remotePath when an upload fails so that
+// the next upload resumes it.
+func resumePaths(remotePath string) (tmpPath, checksumPath string) {
+	tmpPath = filepath.Join(filepath.Dir(remotePath), fmt.Sprintf(".%s.tmp", filepath.Base(remotePath)))
+	return tmpPath, tmpPath + ".sha256"
+}
+
+// uploadResumableFile is like uploadFile, but the temporary file is kept if the
+// upload fails: the next upload of remotePath resumes from its size, minus
+// resumeMargin, instead of restarting from zero. The checksum of the local file
+// src is recorded in a sidecar file of the temporary file, so that only an
+// upload of the same content is resumed. A resumed upload is verified with the
+// checksum before the rename and, if it does not match or cannot be computed on
+// the remote host, uploaded again from zero. size is the size of src.
+func (service *Service) uploadResumableFile(remotePath, localPath string, src *os.File, size int64) error {
+	tmpPath, checksumPath := resumePaths(remotePath)
+	checksum, err := fileChecksum(src)
+	if err != nil {
+		return err
+	}
+	offset := service.resumeOffset(tmpPath, checksumPath, checksum, size)
+	err = service.writeResumableFile(tmpPath, checksumPath, checksum, localPath, src, size, offset)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		if verifyErr := service.verifyChecksum(tmpPath, checksum); verifyErr != nil {
+			service.runner.SendMessage(service.Name, fmt.Sprintf("%s: uploading %s again from zero", verifyErr, localPath), MessageNormal)
+			err = service.writeResumableFile(tmpPath, checksumPath, checksum, localPath, src, size, 0)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = service.client.SftClient.PosixRename(tmpPath, remotePath)
+	if err != nil {
+		service.client.SftClient.Remove(tmpPath)
+		service.client.SftClient.Remove(checksumPath)
+		return err
+	}
+	service.client.SftClient.Remove(checksumPath)
+	return nil
+}
+
+// resumeOffset returns the offset where the upload of the content with checksum
+// in the temporary file tmpPath resumes: the size of tmpPath minus
+// resumeMargin if checksumPath records the same checksum, otherwise zero.
+func (service *Service) resumeOffset(tmpPath, checksumPath, checksum string, size int64) int64 {
+	info, err := service.client.SftClient.Stat(tmpPath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > size {
+		return 0
+	}
+	file, err := service.client.SftClient.Open(checksumPath)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	recorded, err := io.ReadAll(io.LimitReader(file, 128))
+	if err != nil || strings.TrimSpace(string(recorded)) != checksum {
+		return 0
+	}
+	offset := info.Size() - resumeMargin
+	if offset < 0 {
+		return 0
+	}
+	return offset
+}
+
+// writeResumableFile writes in tmpPath the content of src from offset. When
+// starting from zero, checksum is recorded in checksumPath once tmpPath is
+// truncated, so that the recorded checksum always describes the content of
+// tmpPath.
+func (service *Service) writeResumableFile(tmpPath, checksumPath, checksum, localPath string, src *os.File, size, offset int64) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY
+	}
+	dstFile, err := service.client.SftClient.OpenFile(tmpPath, flags)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		service.runner.SendMessage(service.Name, fmt.Sprintf("resuming upload of %s from %d bytes", localPath, offset), MessageNormal)
+		err = dstFile.Truncate(offset)
+		if err == nil {
+			_, err = dstFile.Seek(offset, io.SeekStart)
+		}
+	} else {
+		err = service.writeChecksumFile(checksumPath, checksum)
+	}
+	if err == nil {
+		_, err = src.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		var reader io.Reader = src
+		if size >= progressMinSize {
+			reader = service.newProgressReader(localPath, src, size, offset)
+		}
+		err = service.writeFile(dstFile, reader)
+	}
+	closeErr := dstFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeChecksumFile writes checksum in the remote file path.
+func (service *Service) writeChecksumFile(path, checksum string) error {
+	file, err := service.client.SftClient.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(file, checksum+"\n")
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// verifyChecksum returns an error if the SHA-256 checksum of the remote file
+// path is not checksum, or if it cannot be computed: the remote host needs
+// sha256sum or, like on BSD and macOS, shasum.
+func (service *Service) verifyChecksum(path, checksum string) error {
+	output, err := service.Exec(fmt.Sprintf("sha256sum %[1]s 2>/dev/null || shasum -a 256 %[1]s", shellQuote(path)))
+	if err != nil {
+		return fmt.Errorf("cannot compute the checksum of %s: %s", path, output)
+	}
+	if remoteChecksum := strings.Fields(output + " ")[0]; remoteChecksum != checksum {
+		return fmt.Errorf("checksum mismatch of %s", path)
+	}
+	return nil
+}
+
+// fileChecksum returns the hex encoded SHA-256 checksum of the content of file,
+// and seeks file back to its start.
+func fileChecksum(file *os.File) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeFile writes the content of src in dstFile, with SftpConcurrency
+// concurrent write requests if it is greater than one.
+func (service *Service) writeFile(dstFile *sftp.File, src io.Reader) error {
+	var err error
+	if concurrency := service.runner.SftpConcurrency; concurrency > 1 {
+		_, err = dstFile.ReadFromWithConcurrency(src, concurrency)
+	} else {
+		_, err = dstFile.ReadFrom(src)
+	}
+	return err
+}
+
+// uploadCompressedFile is like uploadFile, but the content of src is gzipped
+// during the upload and decompressed on the remote host with gunzip.
+func (service *Service) uploadCompressedFile(remotePath string, src io.Reader, mode os.FileMode) error {
+	reader, writer := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(writer)
+		_, err := io.Copy(gz, src)
+		if err == nil {
+			err = gz.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	dir, name := filepath.Dir(remotePath), filepath.Base(remotePath)
+	gzPath := filepath.Join(dir, fmt.Sprintf(".%s.gz", name))
+	err := service.uploadFile(gzPath, reader, 0)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dir, fmt.Sprintf(".%s.tmp", name))
+	cmd := fmt.Sprintf("gunzip -c %[1]s > %[2]s && mv %[2]s %[3]s; status=$?; rm -f %[1]s %[2]s; exit $status", shellQuote(gzPath), shellQuote(tmpPath), shellQuote(remotePath))
+	if output, err := service.Exec(cmd); err != nil {
+		return fmt.Errorf("cannot decompress %s: %s", remotePath, output)
+	}
+	if mode != 0 {
+		return service.client.SftClient.Chmod(remotePath, mode)
+	}
+	return nil
+}
+
+// expandSpecifiers replaces in value the systemd specifiers %h and %u with the
+// home directory and the name of the remote user, and %% with %. The other
+// specifiers are left untouched.
+func (service *Service) expandSpecifiers(value string) string {
+	if !strings.Contains(value, "%") {
+		return value
+	}
+	var expanded strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' || i+1 == len(value) {
+			expanded.WriteByte(value[i])
+			continue
+		}
+		switch value[i+1] {
+		case 'h':
+			expanded.WriteString(service.remoteHomeDir)
+		case 'u':
+			expanded.WriteString(service.Conf.User)
+		case '%':
+			expanded.WriteByte('%')
+		default:
+			expanded.WriteString(value[i : i+2])
+		}
+		i++
+	}
+	return expanded.String()
+}
+
+// Prefix of the comment written in the service files, followed by the service
+// name, used to recognize the files installed by god.
+const managedMarker = "# Managed by god - service: "
+
+// managedMarkerLine returns the comment line that marks the service file as
+// written by god.
+func (service *Service) managedMarkerLine() string {
+	return managedMarker + service.unitName()
+}
+
+// isManagedServiceFile reports whether content is a service file written by
+// god for the service: it has the managed marker or, if written by a version
+// of god without marker, it starts like the service file template.
+func (service *Service) isManagedServiceFile(content string) bool {
+	name := service.unitName()
+	if strings.Contains(content, service.managedMarkerLine()+"\n") || strings.HasSuffix(content, service.managedMarkerLine()) {
+		return true
+	}
+	for _, header := range []string{"[Unit]\nDescription=%s\n", "#!/sbin/openrc-run\n\ndescription=\"%s\"\n", "#!/bin/sh\n# %s\n"} {
+		if strings.HasPrefix(content, fmt.Sprintf(header, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceFilePath returns the remote path of the unit service file.
+func (service *Service) serviceFilePath() string {
+	return filepath.Join(service.Conf.SystemdServicesDirectory, fmt.Sprintf(service.initSystem().serviceFileName, service.unitName()))
+}
+
+// execWithMise runs cmd on the remote host and returns its output. Depending on
+// the use_mise configuration, cmd is also tried through `mise exec`: after the
+// plain command (auto), before it (true) or never (false). Returns an empty
+// string if every attempt fails.
+func (service *Service) execWithMise(cmd string) string {
+	var cmds []string
+	switch service.Conf.UseMise {
+	case "true":
+		cmds = []string{"mise exec -- " + cmd, cmd}
+	case "false":
+		cmds = []string{cmd}
+	default:
+		cmds = []string{cmd, "mise exec -- " + cmd}
+	}
+	for _, c := range cmds {
+		output, err := service.Exec(c)
+		if err == nil && output != "" {
+			return output
+		}
+	}
+	return ""
+}
+
+// Files smaller than progressMinSize are copied without reporting progress.
+const progressMinSize = 10 << 20 // 10 MiB
+
+// progressReader wraps reader calling report every 10% of size read.
+type progressReader struct {
+	reader   io.Reader
+	size     int64
+	read     int64
+	reported int64
+	report   func(percent int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	percent := r.read * 100 / r.size
+	if percent >= r.reported+10 {
+		r.reported = percent - percent%10
+		r.report(percent)
+	}
+	return n, err
+}
+
+// execPath returns the executable path of the command cmd.
+func execPath(cmd string) string {
+	return strings.Fields(cmd + " ")[0]
+}
+
+// parseEnvironment splits the space-separated variable assignments of
+// environment. Quotes group words, and a word that is not an assignment is
+// part of the value of the previous one, so `A=hello world B=1` sets A to
+// `hello world`.
+func parseEnvironment(environment string) []string {
+	var assignments []string
+	var word strings.Builder
+	inWord, isAssignment := false, false
+	var quote rune
+	flush := func() {
+		if !inWord {
+			return
+		}
+		if isAssignment || len(assignments) == 0 {
+			assignments = append(assignments, word.String())
+		} else {
+			assignments[len(assignments)-1] += " " + word.String()
+		}
+		word.Reset()
+		inWord, isAssignment = false, false
+	}
+	runes := []rune(environment)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == '"' && c == '\\' && i+1 < len(runes):
+			i++
+			word.WriteRune(runes[i])
+		case quote != 0:
+			word.WriteRune(c)
+		case c == '"' || c == '\'':
+			if !inWord {
+				isAssignment = environmentNameRegExp.MatchString(string(runes[i+1:]))
+			}
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		default:
+			if !inWord {
+				isAssignment = environmentNameRegExp.MatchString(string(runes[i:]))
+			}
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	flush()
+	return assignments
+}
+
+var environmentNameRegExp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// quoteEnvironment returns the assignments of environment, separated by
+// spaces, quoting with quote the values containing any of the special
+// characters.
+func quoteEnvironment(environment, special string, quote func(name, value string) string) string {
+	assignments := parseEnvironment(environment)
+	for i, assignment := range assignments {
+		name, value, found := strings.Cut(assignment, "=")
+		if found && strings.ContainsAny(value, special) {
+			assignments[i] = quote(name, value)
+		}
+	}
+	return strings.Join(assignments, " ")
+}
+
+// systemdEnvironment returns environment as the value of a systemd
+// Environment= line. Values with spaces, quotes or backslashes are double
+// quoted; `$` is literal for systemd and systemd specifiers like `%h` are
+// left to systemd.
+func systemdEnvironment(environment string) string {
+	return quoteEnvironment(environment, " \t\n\"'\\", func(name, value string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name+"="+value) + `"`
+	})
+}
+
+// shellEnvironment returns environment as the arguments of a shell export
+// command. Values with characters special to the shell are single quoted, so
+// that they are set as written, like in the systemd unit.
+func shellEnvironment(environment string) string {
+	return quoteEnvironment(environment, " \t\n\"'\\$`;&|<>()*?[]#~!{}", func(name, value string) string {
+		return name + "=" + shellQuote(value)
+	})
+}
@@ -0,0 +1,180 @@
+package runner
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// renderServiceFile returns the service file of the service name generated
+// with conf.
+func renderServiceFile(t *testing.T, name string, conf *Conf) string {
+	t.Helper()
+	service := Service{Name: name, Conf: conf}
+	var buf bytes.Buffer
+	if err := service.GenerateServiceFile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// renderedLine returns the first line of the service file starting with
+// prefix.
+func renderedLine(t *testing.T, serviceFile, prefix string) string {
+	t.Helper()
+	for _, line := range strings.Split(serviceFile, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+	t.Fatalf("no line starting with %q in:\n%s", prefix, serviceFile)
+	return ""
+}
+
+func TestGenerateServiceFileEnvironment(t *testing.T) {
+	tests := []struct {
+		environment string
+		systemd     string
+		shell       string
+	}{
+		{
+			environment: "PORT=8080 MODE=production",
+			systemd:     "Environment=PORT=8080 MODE=production",
+			shell:       "export PORT=8080 MODE=production",
+		},
+		{
+			environment: "GREETING=hello world PORT=8080",
+			systemd:     `Environment="GREETING=hello world" PORT=8080`,
+			shell:       `export GREETING='hello world' PORT=8080`,
+		},
+		{
+			environment: `GREETING="hello world"`,
+			systemd:     `Environment="GREETING=hello world"`,
+			shell:       `export GREETING='hello world'`,
+		},
+		{
+			environment: `QUOTE='say "hi"' NAME="it's"`,
+			systemd:     `Environment="QUOTE=say \"hi\"" "NAME=it's"`,
+			shell:       `export QUOTE='say "hi"' NAME='it'\''s'`,
+		},
+		{
+			environment: `PATTERN="a\\b"`,
+			systemd:     `Environment="PATTERN=a\\b"`,
+			shell:       `export PATTERN='a\b'`,
+		},
+		{
+			environment: "DATA=%h/data RATE=100%%",
+			systemd:     "Environment=DATA=%h/data RATE=100%%",
+			shell:       "export DATA=%h/data RATE=100%%",
+		},
+		{
+			environment: "PRICE=$5 HOME_DIR='$HOME'",
+			systemd:     "Environment=PRICE=$5 HOME_DIR=$HOME",
+			shell:       "export PRICE='$5' HOME_DIR='$HOME'",
+		},
+		{
+			environment: "TOKEN='$a b%c\"d'",
+			systemd:     `Environment="TOKEN=$a b%c\"d"`,
+			shell:       `export TOKEN='$a b%c"d'`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.environment, func(t *testing.T) {
+			conf := &Conf{ExecStart: "/home/god/go/bin/app", WorkingDirectory: "/home/god", Environment: test.environment}
+			if line := renderedLine(t, renderServiceFile(t, "app", conf), "Environment="); line != test.systemd {
+				t.Errorf("systemd: got %s, want %s", line, test.systemd)
+			}
+			for _, initSystem := range []string{"openrc", "runit"} {
+				conf.InitSystem = initSystem
+				if line := renderedLine(t, renderServiceFile(t, "app", conf), "export "); line != test.shell {
+					t.Errorf("%s: got %s, want %s", initSystem, line, test.shell)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateServiceFileSpecifiers(t *testing.T) {
+	server := startTestServer(t)
+	r := makeTestRunner(t, `app:
+  user: god
+  host: 127.0.0.1
+  port: `+server.port+`
+  private_key_path: {{key}}
+  go_install: example.com/app@latest
+  working_directory: "%h/app"
+  exec_start: "%h/go/bin/app -config %h/app/%u.yml"
+`)
+	service, err := r.MakeService("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceFile := renderServiceFile(t, "app", service.unitConf)
+	if line := renderedLine(t, serviceFile, "WorkingDirectory="); line != "WorkingDirectory=%h/app" {
+		t.Errorf("got %s, want WorkingDirectory=%%h/app", line)
+	}
+	if line := renderedLine(t, serviceFile, "ExecStart="); line != "ExecStart=%h/go/bin/app -config %h/app/%u.yml" {
+		t.Errorf("got %s, want ExecStart=%%h/go/bin/app -config %%h/app/%%u.yml", line)
+	}
+	var buf bytes.Buffer
+	if err := service.GenerateServiceFile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != serviceFile {
+		t.Errorf("the service file is not generated from the configuration with the specifiers")
+	}
+
+	// The commands run by god use the expanded values
+	if service.Conf.WorkingDirectory != "/home/god/app" {
+		t.Errorf("got working directory %s, want /home/god/app", service.Conf.WorkingDirectory)
+	}
+	if service.Conf.ExecStart != "/home/god/go/bin/app -config /home/god/app/god.yml" {
+		t.Errorf("got exec_start %s, want /home/god/go/bin/app -config /home/god/app/god.yml", service.Conf.ExecStart)
+	}
+}
+
+func TestGenerateServiceFileInterpolatedEnvironment(t *testing.T) {
+	t.Setenv("GIT_SHA", "0123abc")
+	t.Setenv("BUILD_NUMBER", "")
+	server := startTestServer(t)
+	r := makeTestRunner(t, `app:
+  user: god
+  host: 127.0.0.1
+  port: `+server.port+`
+  private_key_path: {{key}}
+  go_install: example.com/app@latest
+  environment: GIT_SHA=${GIT_SHA} BUILD=${BUILD_NUMBER:-dev} RAW=$${GIT_SHA}
+`)
+	service, err := r.MakeService("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := service.GenerateServiceFile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "Environment=GIT_SHA=0123abc BUILD=dev RAW=${GIT_SHA}"
+	if line := renderedLine(t, buf.String(), "Environment="); line != want {
+		t.Errorf("got %s, want %s", line, want)
+	}
+}
+
+func TestGenerateServiceFileManagedMarker(t *testing.T) {
+	for _, initSystem := range []string{"systemd", "openrc", "runit"} {
+		t.Run(initSystem, func(t *testing.T) {
+			service := Service{Name: "app", Conf: &Conf{ExecStart: "/home/god/go/bin/app", WorkingDirectory: "/home/god", InitSystem: initSystem, UnitName: "web"}}
+			var buf bytes.Buffer
+			if err := service.GenerateServiceFile(&buf); err != nil {
+				t.Fatal(err)
+			}
+			renderedLine(t, buf.String(), "# Managed by god - service: web")
+			if !service.isManagedServiceFile(buf.String()) {
+				t.Error("the generated service file is not recognized as managed by god")
+			}
+			other := Service{Name: "other", Conf: &Conf{InitSystem: initSystem}}
+			if other.isManagedServiceFile(buf.String()) {
+				t.Error("the service file of web is recognized as the service file of other")
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// isSopsEncrypted reports whether the YAML document buf is encrypted with SOPS,
+// that is it has the top-level `sops` metadata key.
+func isSopsEncrypted(buf []byte) bool {
+	var document struct {
+		Sops *yaml.Node `yaml:"sops"`
+	}
+	return yaml.Unmarshal(buf, &document) == nil && document.Sops != nil
+}
+
+// sopsDecrypt decrypts the SOPS-encrypted file filename, in format yaml or
+// json, in memory with the sops command and returns it as YAML. If filename is
+// `-`, the content buf read from the standard input is decrypted. The
+// decryption keys are found by sops as usual, ex: from SOPS_AGE_KEY_FILE or the
+// cloud KMS credentials.
+func sopsDecrypt(filename, format string, buf []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	path := filename
+	if filename == "-" {
+		path = "/dev/stdin"
+	}
+	cmd := exec.Command("sops", "--decrypt", "--input-type", format, "--output-type", "yaml", path)
+	cmd.Stdin = bytes.NewReader(buf)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errorMessage := strings.TrimSpace(stderr.String()); errorMessage != "" {
+			return nil, fmt.Errorf("cannot decrypt `%s` file with sops: %s", filename, errorMessage)
+		}
+		return nil, fmt.Errorf("cannot decrypt `%s` file with sops: %s", filename, err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,66 @@
+package runner
+
+import (
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadFailedServices returns the services that failed the last time command was
+// run, as recorded in the state file at statePath.
+func LoadFailedServices(statePath, command string) ([]string, error) {
+	state, err := readState(statePath)
+	if err != nil {
+		return nil, err
+	}
+	return state[command], nil
+}
+
+// SaveFailedServices records in the state file at statePath the services that
+// failed running command, replacing those of the previous run of the same
+// command.
+func SaveFailedServices(statePath, command string, serviceNames []string) error {
+	state, err := readState(statePath)
+	if err != nil {
+		return err
+	}
+	if len(serviceNames) == 0 {
+		delete(state, command)
+	} else {
+		names := append([]string(nil), serviceNames...)
+		sort.Strings(names)
+		state[command] = names
+	}
+	if len(state) == 0 {
+		err = os.Remove(statePath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	buf, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath, buf, 0644)
+}
+
+func readState(statePath string) (map[string][]string, error) {
+	state := make(map[string][]string)
+	buf, err := ioutil.ReadFile(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(buf, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
@@ -0,0 +1,37 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+
+package runner
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/pioz/god/sshcmd"
+)
+
+// terminalWidth returns 0: the terminal size is not detected on this platform,
+// so messages are not wrapped.
+func terminalWidth(w io.Writer) int {
+	return 0
+}
+
+// errNoTerminal is returned by the terminal functions on this platform.
+var errNoTerminal = errors.New("terminals are not supported on this platform")
+
+// terminalSize returns errNoTerminal.
+func terminalSize(f *os.File) (sshcmd.WindowSize, error) {
+	return sshcmd.WindowSize{}, errNoTerminal
+}
+
+// makeRaw returns errNoTerminal.
+func makeRaw(f *os.File) (func(), error) {
+	return nil, errNoTerminal
+}
+
+// notifyResize returns a channel that never receives: resizes are not detected
+// on this platform.
+func notifyResize(f *os.File) (<-chan sshcmd.WindowSize, func()) {
+	sizes := make(chan sshcmd.WindowSize)
+	return sizes, func() { close(sizes) }
+}
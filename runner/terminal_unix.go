@@ -0,0 +1,88 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package runner
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pioz/god/sshcmd"
+	"golang.org/x/sys/unix"
+)
+
+// terminalWidth returns the number of columns of the terminal w, or 0 if w is
+// not a terminal.
+func terminalWidth(w io.Writer) int {
+	f, ok := w.(*os.File)
+	if !ok {
+		return 0
+	}
+	size, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return 0
+	}
+	return int(size.Col)
+}
+
+// terminalSize returns the size of the terminal f.
+func terminalSize(f *os.File) (sshcmd.WindowSize, error) {
+	size, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return sshcmd.WindowSize{}, err
+	}
+	return sshcmd.WindowSize{Width: int(size.Col), Height: int(size.Row)}, nil
+}
+
+// makeRaw puts the terminal f in raw mode, so that every key is sent as is to
+// the remote host, and returns the function that restores the previous mode.
+func makeRaw(f *os.File) (func(), error) {
+	fd := int(f.Fd())
+	termios, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	if err != nil {
+		return nil, err
+	}
+	previous := *termios
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlWriteTermios, termios); err != nil {
+		return nil, err
+	}
+	return func() { unix.IoctlSetTermios(fd, ioctlWriteTermios, &previous) }, nil
+}
+
+// notifyResize sends on the returned channel the new size of the terminal f
+// each time it is resized, until the returned stop function is called.
+func notifyResize(f *os.File) (<-chan sshcmd.WindowSize, func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGWINCH)
+	sizes := make(chan sshcmd.WindowSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(sizes)
+		for {
+			select {
+			case <-signals:
+				if size, err := terminalSize(f); err == nil {
+					select {
+					case sizes <- size:
+					case <-done:
+						return
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return sizes, func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build aix || linux || solaris
+
+package runner
+
+import "golang.org/x/sys/unix"
+
+// ioctl requests that read and write the termios of a terminal
+const (
+	ioctlReadTermios  = unix.TCGETS
+	ioctlWriteTermios = unix.TCSETS
+)
@@ -0,0 +1,127 @@
+package runner
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch watches the local files of the services serviceNames and calls fn on
+// the services whose files changed. Changes are debounced: fn is called when
+// the files did not change for delay. Services are made once, so their
+// connection is reused across calls, and connected again if it was dropped.
+// Watch returns when the runner context is
+// done, or an error if the files cannot be watched.
+func (r *Runner) Watch(serviceNames []string, delay time.Duration, fn func(s *Service) error) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	watched := make(map[string][]string)
+	for _, serviceName := range serviceNames {
+		paths, err := r.watchedPaths(serviceName)
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if err := addWatches(watcher, path); err != nil {
+				return err
+			}
+		}
+		watched[serviceName] = paths
+	}
+	changed := make(map[string]bool)
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-r.ctx.Done():
+			return nil
+		case event := <-watcher.Events:
+			// Directories created inside a watched directory are watched too
+			if event.Op&fsnotify.Create != 0 {
+				addWatches(watcher, event.Name)
+			}
+			for serviceName, paths := range watched {
+				if isWatched(paths, event.Name) {
+					changed[serviceName] = true
+					settled = time.After(delay)
+				}
+			}
+		case <-watcher.Errors:
+			// Events might be lost, ex: on queue overflow
+			for serviceName := range watched {
+				changed[serviceName] = true
+			}
+			settled = time.After(delay)
+		case <-settled:
+			var names []string
+			for serviceName := range changed {
+				r.SendMessage(serviceName, "Local files changed", MessageNormal)
+				names = append(names, serviceName)
+			}
+			changed = make(map[string]bool)
+			settled = nil
+			r.Run(names, fn)
+		}
+	}
+}
+
+// watchedPaths returns the absolute paths of the files and directories
+// watched by the service: the watch paths or, if not set, the copy_files
+// paths.
+func (r *Runner) watchedPaths(serviceName string) ([]string, error) {
+	conf, found := r.conf[serviceName]
+	if !found {
+		return nil, nil
+	}
+	paths := conf.Watch
+	if len(paths) == 0 {
+		for _, copyFile := range conf.CopyFiles {
+			paths = append(paths, copyFile.Path)
+		}
+	}
+	var absPaths []string
+	for _, path := range paths {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		absPaths = append(absPaths, absPath)
+	}
+	return absPaths, nil
+}
+
+// addWatches adds to watcher path, if a directory, and its subdirectories. A
+// file is watched through its directory, so that it is still watched when
+// replaced, like editors do on save.
+func addWatches(watcher *fsnotify.Watcher, path string) error {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		dir := filepath.Dir(path)
+		if _, err := os.Stat(dir); err != nil {
+			return nil
+		}
+		return watcher.Add(dir)
+	}
+	return filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		return watcher.Add(path)
+	})
+}
+
+// isWatched reports whether name is one of paths or is inside one of them.
+func isWatched(paths []string, name string) bool {
+	for _, path := range paths {
+		if name == path || strings.HasPrefix(name, path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package runner
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	server := startTestServer(t)
+	dir := t.TempDir()
+	assets := filepath.Join(dir, "assets")
+	if err := os.MkdirAll(filepath.Join(assets, "css"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config.yml")
+	if err := os.WriteFile(config, []byte("debug: false\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := makeTestRunner(t, `web:
+  user: god
+  host: 127.0.0.1
+  port: `+server.port+`
+  private_key_path: {{key}}
+  go_install: example.com/web@latest
+  watch: [`+assets+`]
+api:
+  user: god
+  host: 127.0.0.1
+  port: `+server.port+`
+  private_key_path: {{key}}
+  go_install: example.com/api@latest
+  copy_files: [`+config+`]
+`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.SetContext(ctx)
+
+	calls := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- r.Watch([]string{"web", "api"}, 50*time.Millisecond, func(s *Service) error {
+			calls <- s.Name
+			return nil
+		})
+	}()
+	expectCall := func(want string) {
+		t.Helper()
+		select {
+		case got := <-calls:
+			if got != want {
+				t.Fatalf("got a call for %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no call for %s", want)
+		}
+	}
+
+	// Give Watch the time to add the watches
+	time.Sleep(200 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(assets, "css", "site.css"), []byte("body {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectCall("web")
+
+	// A file replaced by rename, like editors do on save, is still watched
+	replacement := filepath.Join(dir, "config.yml.new")
+	if err := os.WriteFile(replacement, []byte("debug: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replacement, config); err != nil {
+		t.Fatal(err)
+	}
+	expectCall("api")
+
+	// A changed file that is not watched calls nothing
+	if err := os.WriteFile(filepath.Join(dir, "other.txt"), []byte("other\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-calls:
+		t.Errorf("got a call for %s, want none", got)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -3,17 +3,28 @@ package sshcmd
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
 	"io/fs"
 	"io/ioutil"
 	"net"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
+// ErrPassphraseMissing is returned by Connect when the private key is encrypted
+// and the passphrase is not set.
+var ErrPassphraseMissing = errors.New("the private key is encrypted and no passphrase was provided")
+
 // Client is a wrapped around ssh.Client to run commands on a remote host via
 // ssh using a simple and easy to use APIs.
 type Client struct {
@@ -22,11 +33,43 @@ type Client struct {
 	Username  string
 	Host      string
 	Port      string
+	// Expected public key of the remote host, in authorized_keys format or as
+	// base64 wire format. If empty, any host key is accepted.
+	HostKey string
+	// URL of the socks5:// or http:// proxy used to connect to the remote host.
+	// If empty, the client connects directly.
+	Proxy string
+	// Passphrase of the private key, if encrypted.
+	Passphrase string
+	// How long to retry resolving the host name if it cannot be resolved yet,
+	// ex: on overlay networks where DNS lags the tunnel. Zero disables the
+	// retry.
+	ResolveTimeout time.Duration
+	// Allowed key exchange, cipher, MAC and host key algorithms, in order of
+	// preference. If empty, the defaults of golang.org/x/crypto/ssh are used.
+	KeyExchanges      []string
+	Ciphers           []string
+	MACs              []string
+	HostKeyAlgorithms []string
+	// Forward the local SSH agent ($SSH_AUTH_SOCK) to the commands run on the
+	// remote host, so that they can authenticate with the local keys.
+	ForwardAgent bool
+	// Authenticate only with the keys of the local SSH agent ($SSH_AUTH_SOCK),
+	// ignoring the loaded private keys. Connect fails if the agent is not
+	// available.
+	AgentOnly bool
+	// Shell that runs the commands on the remote host, ex: sh. Commands are
+	// run with `<Shell> -c '<command>'`, so they do not depend on the login
+	// shell of the user. If empty, commands are run by the login shell.
+	Shell string
 
-	privateKey []byte
+	privateKeys [][]byte
+	sftpMu      sync.Mutex
+	closed      chan struct{}
 }
 
-// MakeClient returns an initialized Client.
+// MakeClient returns an initialized Client. If privateKeyPath is empty, no
+// private key is loaded: add them with AddPrivateKey.
 func MakeClient(username, host, port, privateKeyPath string) (*Client, error) {
 	if port == "" {
 		port = "22"
@@ -37,20 +80,53 @@ func MakeClient(username, host, port, privateKeyPath string) (*Client, error) {
 		Port:     port,
 	}
 
+	if privateKeyPath != "" {
+		if err := client.AddPrivateKey(privateKeyPath); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// AddPrivateKey loads the private key at privateKeyPath. All loaded keys are
+// offered to the remote host, that accepts the first one authorized.
+func (c *Client) AddPrivateKey(privateKeyPath string) error {
 	bytes, err := ioutil.ReadFile(privateKeyPath)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	client.privateKey = bytes
-	return client, nil
+	c.privateKeys = append(c.privateKeys, bytes)
+	return nil
 }
 
 // Connect connects the client to the remote host. After connection, the client
 // is ready to run a command on the remote host.
 func (c *Client) Connect() error {
-	key, err := ssh.ParsePrivateKey(c.privateKey)
-	if err != nil {
-		return err
+	var auth ssh.AuthMethod
+	if c.AgentOnly {
+		agentClient, err := dialAgent()
+		if err != nil {
+			return errors.Wrap(err, "cannot authenticate with the SSH agent")
+		}
+		auth = ssh.PublicKeysCallback(agentClient.Signers)
+	} else {
+		var keys []ssh.Signer
+		for _, privateKey := range c.privateKeys {
+			key, err := c.parsePrivateKey(privateKey)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		auth = ssh.PublicKeys(keys...)
+	}
+	var err error
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if c.HostKey != "" {
+		hostKeyCallback, err = pinnedHostKeyCallback(c.HostKey)
+		if err != nil {
+			return err
+		}
 	}
 	// Authentication
 	config := &ssh.ClientConfig{
@@ -58,23 +134,176 @@ func (c *Client) Connect() error {
 		// https://github.com/golang/go/issues/19767
 		// as clientConfig is non-permissive by default
 		// you can set ssh.InsercureIgnoreHostKey to allow any host
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: hostKeyCallback,
+		Auth:            []ssh.AuthMethod{auth},
 		// //alternatively, you could use a password
 		// Auth: []ssh.AuthMethod{ssh.Password("PASSWORD")},
+		HostKeyAlgorithms: c.HostKeyAlgorithms,
 	}
+	config.KeyExchanges = c.KeyExchanges
+	config.Ciphers = c.Ciphers
+	config.MACs = c.MACs
 	// Connect
-	client, err := ssh.Dial("tcp", net.JoinHostPort(c.Host, c.Port), config)
+	addr := net.JoinHostPort(c.Host, c.Port)
+	if c.Proxy == "" {
+		if err := c.waitResolvable(); err != nil {
+			return err
+		}
+	}
+	if c.Proxy != "" {
+		conn, err := dialProxy(c.Proxy, addr)
+		if err != nil {
+			return err
+		}
+		// The SSH handshake through the tunnel must not hang either
+		conn.SetDeadline(time.Now().Add(proxyTimeout))
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		conn.SetDeadline(time.Time{})
+		c.SshClient = ssh.NewClient(sshConn, chans, reqs)
+		c.watchConnection()
+		return c.forwardAgent()
+	}
+	client, err := ssh.Dial("tcp", addr, config)
 	if err != nil {
 		return err
 	}
 	c.SshClient = client
-	return nil
+	c.watchConnection()
+	return c.forwardAgent()
+}
+
+// watchConnection records when the connection of SshClient is closed, so that
+// Closed reports it.
+func (c *Client) watchConnection() {
+	closed := make(chan struct{})
+	c.closed = closed
+	go func() {
+		c.SshClient.Wait()
+		close(closed)
+	}()
+}
+
+// Closed reports whether the connection to the remote host was closed after
+// Connect, ex: dropped by the network or by the remote host. A closed client
+// cannot run commands anymore: connect a new one.
+func (c *Client) Closed() bool {
+	if c.closed == nil {
+		return false
+	}
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// forwardAgent serves the agent forwarding requests of the remote host with the
+// local SSH agent, if ForwardAgent is true.
+func (c *Client) forwardAgent() error {
+	if !c.ForwardAgent {
+		return nil
+	}
+	agentClient, err := dialAgent()
+	if err != nil {
+		return errors.Wrap(err, "cannot forward the SSH agent")
+	}
+	return agent.ForwardToAgent(c.SshClient, agentClient)
+}
+
+// dialAgent connects to the local SSH agent listening on $SSH_AUTH_SOCK.
+func dialAgent() (agent.ExtendedAgent, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot connect to the SSH agent")
+	}
+	return agent.NewClient(conn), nil
+}
+
+// parsePrivateKey parses privateKey, decrypting it with Passphrase if
+// encrypted.
+func (c *Client) parsePrivateKey(privateKey []byte) (ssh.Signer, error) {
+	key, err := ssh.ParsePrivateKey(privateKey)
+	var passphraseErr *ssh.PassphraseMissingError
+	if errors.As(err, &passphraseErr) {
+		if c.Passphrase == "" {
+			return nil, ErrPassphraseMissing
+		}
+		key, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, []byte(c.Passphrase))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decrypt the private key")
+		}
+	}
+	return key, err
+}
+
+// Interval between the attempts to resolve the host name.
+const resolveInterval = time.Second
+
+// waitResolvable resolves the host name, retrying for ResolveTimeout while the
+// name is not found. The error tells name resolution failures apart from
+// connection failures.
+func (c *Client) waitResolvable() error {
+	if net.ParseIP(c.Host) != nil {
+		return nil
+	}
+	deadline := time.Now().Add(c.ResolveTimeout)
+	for {
+		_, err := net.LookupHost(c.Host)
+		if err == nil {
+			return nil
+		}
+		var dnsErr *net.DNSError
+		retryable := errors.As(err, &dnsErr) && (dnsErr.IsNotFound || dnsErr.IsTemporary || dnsErr.IsTimeout)
+		if !retryable || time.Now().Add(resolveInterval).After(deadline) {
+			if c.ResolveTimeout > 0 {
+				return errors.Wrapf(err, "host name `%s` is not resolvable after %s", c.Host, c.ResolveTimeout)
+			}
+			return errors.Wrapf(err, "host name `%s` is not resolvable", c.Host)
+		}
+		time.Sleep(resolveInterval)
+	}
+}
+
+// pinnedHostKeyCallback returns a ssh.HostKeyCallback that accepts only
+// hostKey.
+func pinnedHostKeyCallback(hostKey string) (ssh.HostKeyCallback, error) {
+	var expected ssh.PublicKey
+	var err error
+	if strings.Contains(strings.TrimSpace(hostKey), " ") {
+		expected, _, _, _, err = ssh.ParseAuthorizedKey([]byte(hostKey))
+	} else {
+		var wire []byte
+		wire, err = base64.StdEncoding.DecodeString(strings.TrimSpace(hostKey))
+		if err == nil {
+			expected, err = ssh.ParsePublicKey(wire)
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse host key")
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if !bytes.Equal(key.Marshal(), expected.Marshal()) {
+			return errors.Errorf("HOST KEY MISMATCH for %s: expected %s %s but the host presented %s %s. The host may have been reinstalled, or someone may be intercepting the connection", hostname, expected.Type(), ssh.FingerprintSHA256(expected), key.Type(), ssh.FingerprintSHA256(key))
+		}
+		return nil
+	}, nil
 }
 
 // ConnectSftpClient initialize and connects the sftp.Client using the current
-// ssh.Client. If the sftpClient is already initialized, it has no effect.
+// ssh.Client. If the sftpClient is already initialized, it has no effect. It is
+// safe to call it concurrently.
 func (c *Client) ConnectSftpClient() error {
+	c.sftpMu.Lock()
+	defer c.sftpMu.Unlock()
 	if c.SftClient != nil {
 		return nil
 	}
@@ -89,6 +318,21 @@ func (c *Client) ConnectSftpClient() error {
 // Exec runs a command on the remote host. Returns the output of the command and
 // the error if occurred.
 func (c *Client) Exec(cmd string) (string, error) {
+	return c.ExecContext(context.Background(), cmd)
+}
+
+// ExecContext is like Exec but does not run the command if ctx is already done.
+// A command already started is always allowed to complete.
+func (c *Client) ExecContext(ctx context.Context, cmd string) (string, error) {
+	return c.ExecInput(ctx, cmd, nil)
+}
+
+// ExecInput is like ExecContext, but the standard input of the command reads
+// from stdin. If stdin is nil, the command reads from an empty input.
+func (c *Client) ExecInput(ctx context.Context, cmd string, stdin io.Reader) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	if c.SshClient == nil {
 		return "", errors.New("client is not connected")
 	}
@@ -98,10 +342,19 @@ func (c *Client) Exec(cmd string) (string, error) {
 		return "", err
 	}
 	defer session.Close()
+	if c.ForwardAgent {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			return "", errors.Wrap(err, "cannot request the SSH agent forwarding")
+		}
+	}
 
 	var stdout, stderr bytes.Buffer
+	session.Stdin = stdin
 	session.Stdout = &stdout
 	session.Stderr = &stderr
+	if c.Shell != "" {
+		cmd = c.Shell + " -c " + shellQuote(cmd)
+	}
 	err = session.Run(cmd)
 	if err != nil {
 		return stderr.String(), err
@@ -109,6 +362,55 @@ func (c *Client) Exec(cmd string) (string, error) {
 	return stdout.String(), nil
 }
 
+// WindowSize is the size of a terminal in characters.
+type WindowSize struct {
+	Width  int
+	Height int
+}
+
+// RunTerminal runs cmd on the remote host in a pseudo terminal of type term and
+// size size, connected to stdin, stdout and stderr. The pseudo terminal is
+// resized to each size received from resize. Returns when the command exits.
+func (c *Client) RunTerminal(cmd, term string, size WindowSize, resize <-chan WindowSize, stdin io.Reader, stdout, stderr io.Writer) error {
+	if c.SshClient == nil {
+		return errors.New("client is not connected")
+	}
+	session, err := c.SshClient.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	if c.ForwardAgent {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			return errors.Wrap(err, "cannot request the SSH agent forwarding")
+		}
+	}
+	modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+	if err := session.RequestPty(term, size.Height, size.Width, modes); err != nil {
+		return errors.Wrap(err, "cannot request the pseudo terminal")
+	}
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if c.Shell != "" {
+		cmd = c.Shell + " -c " + shellQuote(cmd)
+	}
+	if err := session.Start(cmd); err != nil {
+		return err
+	}
+	go func() {
+		for size := range resize {
+			session.WindowChange(size.Height, size.Width)
+		}
+	}()
+	return session.Wait()
+}
+
+// shellQuote quotes s as a single argument for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 // WalkDir is a wrapper around filepath.WalkDir.
 func (c *Client) WalkDir(srcPath, dstDir string, fn WalkDirFunc) error {
 	dirs := make([]string, 0)
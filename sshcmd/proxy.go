@@ -0,0 +1,178 @@
+package sshcmd
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// proxyTimeout is the maximum duration of the connection to the proxy and of
+// each handshake on it, so that an unresponsive proxy cannot hang god.
+const proxyTimeout = 30 * time.Second
+
+// dialProxy connects to addr through the proxy at proxyURL. Supported schemes
+// are socks5 and http (HTTP CONNECT). Credentials can be set in the URL user
+// info.
+func dialProxy(proxyURL, addr string) (net.Conn, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy URL")
+	}
+	var connect func(conn net.Conn, u *url.URL, addr string) (net.Conn, error)
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		connect = socks5Connect
+	case "http":
+		connect = httpConnect
+	default:
+		return nil, errors.Errorf("unsupported proxy scheme `%s`: use socks5:// or http://", u.Scheme)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, proxyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(proxyTimeout))
+	tunnel, err := connect(conn, u, addr)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "proxy %s", u.Host)
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// socks5Connect asks the SOCKS5 proxy on conn to connect to addr.
+func socks5Connect(conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	if err := socks5Handshake(conn, u, addr); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// socks5Handshake performs the SOCKS5 handshake (RFC 1928) on conn,
+// authenticating with username and password (RFC 1929) if present in u.
+func socks5Handshake(conn net.Conn, u *url.URL, addr string) error {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return err
+	}
+
+	method := byte(0x00) // no authentication
+	if u.User != nil {
+		method = 0x02 // username/password
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New("authentication method not accepted")
+	}
+	if method == 0x02 {
+		username := u.User.Username()
+		password, _ := u.User.Password()
+		request := []byte{0x01, byte(len(username))}
+		request = append(request, username...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, 0x01)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, 0x04)
+		request = append(request, ip...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return errors.Errorf("connection to %s refused with code %d", addr, header[1])
+	}
+	// Discard the bound address
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// httpConnect asks the HTTP proxy on conn to open a tunnel to addr with the
+// CONNECT method, using basic authentication if credentials are present in u.
+func httpConnect(conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		request += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", credentials)
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("CONNECT to %s failed: %s", addr, response.Status)
+	}
+	// The reader may have buffered data sent by the remote host after the
+	// response, so read the tunnel through it.
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}